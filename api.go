@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+//	No command body comes near this, batches have their own limit
+const maxCommandBytes = 64 * 1024
+
+// A command's path. In /v1 paths, segments in braces are parameters:
+// {user} becomes the request's UserId and {symbol} its StockSymbol.
+type route struct {
+	method  string
+	path    string
+	command string
+	handler http.HandlerFunc
+}
+
+var v1Routes = []route{
+	{"GET", "/v1/users/{user}/quotes/{symbol}", "QUOTE", quoteHandler},
+	{"GET", "/v1/users/{user}/account", "DISPLAY_SUMMARY", displaySummaryHandler},
+	{"POST", "/v1/users/{user}/funds", "ADD", addHandler},
+
+	{"POST", "/v1/users/{user}/buys", "BUY", buyHandler},
+	{"POST", "/v1/users/{user}/buys/latest/commit", "COMMIT_BUY", confirmBuyHandler},
+	{"DELETE", "/v1/users/{user}/buys/latest", "CANCEL_BUY", cancelBuyHandler},
+	{"POST", "/v1/users/{user}/sells", "SELL", sellHandler},
+	{"POST", "/v1/users/{user}/sells/latest/commit", "COMMIT_SELL", confirmSellHandler},
+	{"DELETE", "/v1/users/{user}/sells/latest", "CANCEL_SELL", cancelSellHandler},
+
+	{"POST", "/v1/users/{user}/triggers/buy/{symbol}/amount", "SET_BUY_AMOUNT", setBuyHandler},
+	{"POST", "/v1/users/{user}/triggers/buy/{symbol}/price", "SET_BUY_TRIGGER", setBuyTriggerHandler},
+	{"DELETE", "/v1/users/{user}/triggers/buy/{symbol}", "CANCEL_SET_BUY", cancelSetBuyHandler},
+	{"POST", "/v1/users/{user}/triggers/sell/{symbol}/amount", "SET_SELL_AMOUNT", setSellHandler},
+	{"POST", "/v1/users/{user}/triggers/sell/{symbol}/price", "SET_SELL_TRIGGER", setSellTriggerHandler},
+	{"DELETE", "/v1/users/{user}/triggers/sell/{symbol}", "CANCEL_SET_SELL", cancelSetSellHandler},
+
+	{"GET", accountEventsPath, "WATCH_ACCOUNT", accountEventsHandler},
+
+	{"POST", "/v1/users/{user}/log/dump", "DUMPLOG", dumpLogHandler},
+	{"POST", "/v1/log/dump", "DUMPLOG", dumpLogHandler},
+}
+
+// The original flat command paths. They accept any method, POST is only
+// what the workload generator sends and what the spec documents.
+var legacyRoutes = []route{
+	{"POST", "/quote", "QUOTE", quoteHandler},
+	{"POST", "/add", "ADD", addHandler},
+	{"POST", "/buy", "BUY", buyHandler},
+	{"POST", "/cancelBuy", "CANCEL_BUY", cancelBuyHandler},
+	{"POST", "/confirmBuy", "COMMIT_BUY", confirmBuyHandler},
+	{"POST", "/sell", "SELL", sellHandler},
+	{"POST", "/cancelSell", "CANCEL_SELL", cancelSellHandler},
+	{"POST", "/confirmSell", "COMMIT_SELL", confirmSellHandler},
+	{"POST", "/setBuy", "SET_BUY_AMOUNT", setBuyHandler},
+	{"POST", "/cancelSetBuy", "CANCEL_SET_BUY", cancelSetBuyHandler},
+	{"POST", "/setBuyTrigger", "SET_BUY_TRIGGER", setBuyTriggerHandler},
+	{"POST", "/setSell", "SET_SELL_AMOUNT", setSellHandler},
+	{"POST", "/cancelSetSell", "CANCEL_SET_SELL", cancelSetSellHandler},
+	{"POST", "/setSellTrigger", "SET_SELL_TRIGGER", setSellTriggerHandler},
+	{"POST", "/displaySummary", "DISPLAY_SUMMARY", displaySummaryHandler},
+	{"POST", "/dumpLog", "DUMPLOG", dumpLogHandler},
+}
+
+var (
+	errUnknownCommand   = &apiError{Code: "UNKNOWN_COMMAND", Status: http.StatusBadRequest}
+	errNotFound         = &apiError{Code: "NOT_FOUND", Status: http.StatusNotFound}
+	errMethodNotAllowed = &apiError{Code: "METHOD_NOT_ALLOWED", Status: http.StatusMethodNotAllowed}
+)
+
+//	Path parameters if path matches the route's
+func (rt route) match(path string) (map[string]string, bool) {
+	want := strings.Split(strings.Trim(rt.path, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, segment := range want {
+		if strings.HasPrefix(segment, "{") {
+			if got[i] == "" {
+				return nil, false
+			}
+			params[segment] = got[i]
+		} else if segment != got[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Routes /v1 requests to the same handlers as the legacy paths. Path
+// parameters and a transactionNum query parameter are merged into the JSON
+// body, which is all the handlers read, so both APIs behave identically.
+func v1Handler() http.HandlerFunc {
+	handlers := make([]http.HandlerFunc, len(v1Routes))
+	for i, rt := range v1Routes {
+		handlers[i] = instrument(rt.command, maxCommandBytes, rt.handler)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for i, rt := range v1Routes {
+			params, ok := rt.match(r.URL.Path)
+			if !ok {
+				continue
+			}
+			if rt.method != r.Method {
+				allowed = append(allowed, rt.method)
+				continue
+			}
+
+			body, err := mergeParams(w, r, params)
+			if err != nil {
+				writeError(w, asAPIError(err), 0)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			handlers[i](w, r)
+			return
+		}
+
+		if len(allowed) == 0 {
+			writeError(w, errNotFound.withMessage("no such resource "+r.URL.Path), 0)
+			return
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, errMethodNotAllowed.withMessage(r.Method+" not allowed on "+r.URL.Path), 0)
+	}
+}
+
+//	The request body with path and query parameters set in it. A body that
+//	isn't a JSON object is left alone for the handler to reject, one over
+//	maxCommandBytes is an error.
+func mergeParams(w http.ResponseWriter, r *http.Request, params map[string]string) ([]byte, error) {
+	body, err := readBody(w, r, maxCommandBytes)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	if len(bytes.TrimSpace(body)) > 0 && json.Unmarshal(body, &fields) != nil {
+		return body, nil
+	}
+
+	if user, ok := params["{user}"]; ok {
+		fields["UserId"] = user
+	}
+	if symbol, ok := params["{symbol}"]; ok {
+		fields["StockSymbol"] = symbol
+	}
+	if num := r.URL.Query().Get("transactionNum"); num != "" {
+		if n, err := strconv.Atoi(num); err == nil {
+			fields["TransactionNum"] = n
+		} else {
+			fields["TransactionNum"] = num
+		}
+	}
+
+	merged, _ := json.Marshal(fields)
+	return merged, nil
+}
+
+//	The whole body, unless it runs past limit
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errRequestTooLarge.withMessage("body bigger than " + strconv.FormatInt(limit, 10) + " bytes")
+	}
+	if err != nil {
+		return nil, errBadRequest.withMessage("error reading body").because(err)
+	}
+	return body, nil
+}
+
+// A command's logic. request makes a request with the defaults the command
+// gives fields that are left out, run runs the command on it. decodeErr is
+// why the request didn't decode, if it didn't: the command is audited
+// either way, then rejects it.
+type commandFunc struct {
+	request func() interface{}
+	run     func(ctx context.Context, req interface{}, filename string, decodeErr error) (interface{}, error)
+}
+
+//	Wraps a command's run function, which takes its own request type
+func typedCommand[Req any, Resp any](defaults Req, run func(context.Context, Req, string, error) (Resp, error)) commandFunc {
+	return commandFunc{
+		request: func() interface{} {
+			req := defaults
+			return &req
+		},
+		run: func(ctx context.Context, req interface{}, filename string, decodeErr error) (interface{}, error) {
+			return run(ctx, *req.(*Req), filename, decodeErr)
+		},
+	}
+}
+
+//	DUMPLOG's Server is always SERVER, whatever the caller says
+var commandFuncs = map[string]commandFunc{
+	"QUOTE":            typedCommand(SymbolRequest{TransactionNum: 1}, runQuote),
+	"ADD":              typedCommand(AddRequest{TransactionNum: 1}, runAdd),
+	"BUY":              typedCommand(OrderRequest{TransactionNum: 1}, runBuy),
+	"CANCEL_BUY":       typedCommand(UserRequest{TransactionNum: 1}, runCancelBuy),
+	"COMMIT_BUY":       typedCommand(UserRequest{TransactionNum: 1}, runCommitBuy),
+	"SELL":             typedCommand(OrderRequest{TransactionNum: 1}, runSell),
+	"CANCEL_SELL":      typedCommand(UserRequest{TransactionNum: 1}, runCancelSell),
+	"COMMIT_SELL":      typedCommand(UserRequest{TransactionNum: 1}, runCommitSell),
+	"SET_BUY_AMOUNT":   typedCommand(OrderRequest{TransactionNum: 1}, runSetBuyAmount),
+	"CANCEL_SET_BUY":   typedCommand(SymbolRequest{TransactionNum: 1}, runCancelSetBuy),
+	"SET_BUY_TRIGGER":  typedCommand(OrderRequest{TransactionNum: 1}, runSetBuyTrigger),
+	"SET_SELL_AMOUNT":  typedCommand(OrderRequest{TransactionNum: 1}, runSetSellAmount),
+	"CANCEL_SET_SELL":  typedCommand(SymbolRequest{TransactionNum: 1}, runCancelSetSell),
+	"SET_SELL_TRIGGER": typedCommand(OrderRequest{TransactionNum: 1}, runSetSellTrigger),
+	"DISPLAY_SUMMARY":  typedCommand(UserRequest{TransactionNum: 1}, runDisplaySummary),
+	"DUMPLOG":          typedCommand(DumpLogRequest{TransactionNum: 1, Format: "xml"}, runDumpLog),
+}
+
+var (
+	quoteHandler          = serveCommand("QUOTE")
+	addHandler            = serveCommand("ADD")
+	buyHandler            = serveCommand("BUY")
+	cancelBuyHandler      = serveCommand("CANCEL_BUY")
+	confirmBuyHandler     = serveCommand("COMMIT_BUY")
+	sellHandler           = serveCommand("SELL")
+	cancelSellHandler     = serveCommand("CANCEL_SELL")
+	confirmSellHandler    = serveCommand("COMMIT_SELL")
+	setBuyHandler         = serveCommand("SET_BUY_AMOUNT")
+	cancelSetBuyHandler   = serveCommand("CANCEL_SET_BUY")
+	setBuyTriggerHandler  = serveCommand("SET_BUY_TRIGGER")
+	setSellHandler        = serveCommand("SET_SELL_AMOUNT")
+	cancelSetSellHandler  = serveCommand("CANCEL_SET_SELL")
+	setSellTriggerHandler = serveCommand("SET_SELL_TRIGGER")
+	displaySummaryHandler = serveCommand("DISPLAY_SUMMARY")
+	dumpLogHandler        = serveCommand("DUMPLOG")
+)
+
+//	A command's request decoded from a JSON body, nil if there's no such command
+func jsonRequest(command string, body io.Reader) (interface{}, error) {
+	cmd, ok := commandFuncs[command]
+	if !ok {
+		return nil, nil
+	}
+	req := cmd.request()
+	return req, json.NewDecoder(body).Decode(req)
+}
+
+//	Every request type has a UserId and TransactionNum
+func requestIds(req interface{}) (string, int) {
+	if req == nil {
+		return "", 0
+	}
+	val := reflect.ValueOf(req).Elem()
+	return val.FieldByName("UserId").String(), int(val.FieldByName("TransactionNum").Int())
+}
+
+//	The HTTP handler for a command, its request is the JSON body
+func serveCommand(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, decodeErr := jsonRequest(command, r.Body)
+		userId, transactionNum := requestIds(req)
+		resp, err := commandFuncs[command].run(r.Context(), req, workloadFile(r, userId), decodeErr)
+		if err != nil {
+			writeError(w, asAPIError(err), transactionNum)
+			return
+		}
+
+		switch resp := resp.(type) {
+		case *dumpedLog:
+			serveLog(w, r, resp, transactionNum)
+		case CommandResponse:
+			w.WriteHeader(http.StatusOK)
+		default:
+			body, _ := json.Marshal(resp)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}
+	}
+}
+
+//	Sends a dumped log on, gzipped if the caller can take it
+func serveLog(w http.ResponseWriter, r *http.Request, log *dumpedLog, transactionNum int) {
+	defer log.Body.Close()
+
+	var in io.Reader = log.Body
+	var out io.Writer = w
+	acceptsGzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	switch {
+	case log.Gzipped && acceptsGzip:
+		w.Header().Set("Content-Encoding", "gzip")
+	case acceptsGzip:
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	default:
+		plain, err := log.plain()
+		if err != nil {
+			writeError(w, errAuditUnavailable.withMessage("unreadable dumplog").because(err), transactionNum)
+			return
+		}
+		in = plain
+	}
+
+	w.Header().Set("Content-Type", log.ContentType)
+	//	Quoted and escaped, or left out if the name can't be put in a header at all
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": log.FileName})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", disposition)
+
+	w.WriteHeader(http.StatusOK)
+	_, err := io.Copy(out, in)
+	if err != nil {
+		logFor(r.Context()).Error("Error streaming dumplog", "cause", err)
+	}
+}
+
+// Runs a command in process, for callers that didn't arrive as its own
+// HTTP request (gRPC, /batch, replay). req is from the command's request
+// function, and workload the workload file the caller named, if it did.
+// It's counted, logged and traced like any other command.
+func runCommand(ctx context.Context, command string, req interface{}, decodeErr error, workload string) (interface{}, error) {
+	cmd, ok := commandFuncs[command]
+	if !ok {
+		return nil, errUnknownCommand.withMessage("no such command " + command)
+	}
+
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, command, trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	userId, transactionNum := requestIds(req)
+	ctx = withLogger(ctx, logFor(ctx).With("command", command, "user", userId, "transactionNum", transactionNum))
+
+	resp, err := cmd.run(ctx, req, userWorkloadFile(workload, userId), decodeErr)
+	status := http.StatusOK
+	if err != nil {
+		status = asAPIError(err).Status
+	}
+	handled(ctx, command, start, status)
+	return resp, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//	The command's status and error code for body
+func send(handler http.Handler, method string, path string, body string) (int, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var failure ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &failure)
+	return w.Code, failure.Code
+}
+
+func TestInstrumentRejectsOversizedBody(t *testing.T) {
+	handler := instrument("ADD", maxCommandBytes, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran on an oversized body")
+	})
+	body := `{"UserId": "` + strings.Repeat("a", maxCommandBytes) + `"}`
+
+	status, code := send(handler, "POST", "/add", body)
+	if status != http.StatusRequestEntityTooLarge || code != errRequestTooLarge.Code {
+		t.Errorf("got %d %s, want %d %s", status, code, http.StatusRequestEntityTooLarge, errRequestTooLarge.Code)
+	}
+}
+
+func TestV1RejectsOversizedBody(t *testing.T) {
+	body := `{"Amount": 1, "Padding": "` + strings.Repeat("a", maxCommandBytes) + `"}`
+
+	status, code := send(v1Handler(), "POST", "/v1/users/alice/funds", body)
+	if status != http.StatusRequestEntityTooLarge || code != errRequestTooLarge.Code {
+		t.Errorf("got %d %s, want %d %s", status, code, http.StatusRequestEntityTooLarge, errRequestTooLarge.Code)
+	}
+}
+
+func TestRecordTrafficRejectsOversizedBody(t *testing.T) {
+	trafficLog = &trafficRecorder{}
+	defer func() { trafficLog = nil }()
+	handler := recordTraffic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran on an oversized body")
+	}))
+	body := `{"UserId": "` + strings.Repeat("a", maxCommandBytes) + `"}`
+
+	status, code := send(handler, "POST", "/add", body)
+	if status != http.StatusRequestEntityTooLarge || code != errRequestTooLarge.Code {
+		t.Errorf("got %d %s, want %d %s", status, code, http.StatusRequestEntityTooLarge, errRequestTooLarge.Code)
+	}
+}
@@ -1,179 +1,334 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var (
-	rmqChannel *amqp.Channel
+const (
+	publishAttempts       = 8
+	publishConfirmTimeout = 5 * time.Second
+	publishMinBackoff     = 100 * time.Millisecond
+	publishMaxBackoff     = 5 * time.Second
+	spoolPollInterval     = time.Second
+	auditBatchSize        = 100
+
+	//	Times a batch can be rejected outright before it's dead-lettered
+	auditRejectAttempts = 5
 )
 
-func ErrorAuditer(audits <-chan interface{}) {
+//	The sink got the batch and refused it, as opposed to not getting it at all
+var errAuditBatchRejected = errors.New("audit batch rejected")
 
-	//dump ur shit to the channel
-	var err error
-	rmqChannel, err = rmqConn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer rmqChannel.Close()
-
-	q, err := rmqChannel.QueueDeclare(
-		"error_queue", // name
-		false,         // durable
-		false,         // delete when unused
-		false,         // exclusive
+// rmqSink publishes persistent messages on its own confirm mode channel,
+// reopening it (and picking up a reconnected connection) when it breaks.
+type rmqSink struct {
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+}
+
+func newRMQSink() *rmqSink {
+	return &rmqSink{}
+}
+
+//	Open a confirm mode channel on the current connection and declare our topology
+func (p *rmqSink) open() error {
+	conn := rmqConnection()
+	if conn == nil || conn.IsClosed() {
+		return errors.New("no rabbitmq connection")
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = channel.ExchangeDeclare(
+		auditExchange, // name
+		"topic",       // type
+		true,          // durable
+		false,         // auto-deleted
+		false,         // internal
 		false,         // no-wait
 		nil,           // arguments
 	)
-	failOnError(err, "Failed to declare a queue")
-
-	for auditStruct := range audits {
-
-		body, merr := json.Marshal(auditStruct)
+	if err != nil {
+		channel.Close()
+		return err
+	}
 
-		if merr != nil {
-			fmt.Println("marshal error")
+	//	Keep the old per-type queues filled for the existing audit server.
+	//	Anyone else binds their own queue to the exchange.
+	for _, route := range auditRoutes {
+		if route.Queue == "" {
+			continue
 		}
+		_, err = channel.QueueDeclare(
+			route.Queue, // name
+			true,        // durable
+			false,       // delete when unused
+			false,       // exclusive
+			false,       // no-wait
+			nil,         // arguments
+		)
+		if err == nil {
+			err = channel.QueueBind(route.Queue, route.Topic+".#", route.Exchange, false, nil)
+		}
+		if err != nil {
+			channel.Close()
+			return err
+		}
+	}
 
-		err = rmqChannel.Publish(
-			"",     // exchange
-			q.Name, // routing key
-			false,  // mandatory
-			false,  // immediate
-			amqp.Publishing{
-				ContentType:     "application/json",
-				ContentEncoding: "",
-				Body:            []byte(body),
-			})
-		failOnError(err, "Failed to publish error mq")
-
+	err = channel.Confirm(false)
+	if err != nil {
+		channel.Close()
+		return err
 	}
 
+	p.channel = channel
+	p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, auditBatchSize))
+	return nil
 }
 
-func TransactionAuditer(audits <-chan interface{}) {
-
-	//dump ur shit to the channel
+func (p *rmqSink) Close() error {
 	var err error
-	rmqChannel, err = rmqConn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer rmqChannel.Close()
-
-	q, err := rmqChannel.QueueDeclare(
-		"transaction_queue", // name
-		false,               // durable
-		false,               // delete when unused
-		false,               // exclusive
-		false,               // no-wait
-		nil,                 // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
+	if p.channel != nil {
+		err = p.channel.Close()
+	}
+	p.channel = nil
+	p.confirms = nil
+	return err
+}
 
-	for auditStruct := range audits {
+//	Publish the batch and wait for the broker to confirm all of it.
+//	Retries the whole batch with backoff, reopening the channel between
+//	attempts. A nack is handed straight back for the shipper to count.
+func (p *rmqSink) Publish(batch []AuditMessage) error {
+	var err error
+	backoff := publishMinBackoff
+
+	for attempt := 0; attempt < publishAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > publishMaxBackoff {
+				backoff = publishMaxBackoff
+			}
+		}
 
-		body, merr := json.Marshal(auditStruct)
+		if p.channel == nil {
+			if err = p.open(); err != nil {
+				continue
+			}
+		}
 
-		//dump that shit into rabbitmq
-		if merr != nil {
-			fmt.Println("marshal error")
+		err = p.publishBatch(batch)
+		if err == nil || errors.Is(err, errAuditBatchRejected) {
+			return err
 		}
+	}
+
+	return err
+}
 
-		err = rmqChannel.Publish(
-			"",     // exchange
-			q.Name, // routing key
-			false,  // mandatory
-			false,  // immediate
+func (p *rmqSink) publishBatch(batch []AuditMessage) error {
+	for _, msg := range batch {
+		//	Consumers can pick the trace up from the traceparent header
+		var headers amqp.Table
+		if msg.TraceParent != "" {
+			headers = amqp.Table{"traceparent": msg.TraceParent}
+		}
+		err := p.channel.Publish(
+			msg.Exchange,   // exchange
+			msg.RoutingKey, // routing key
+			false,          // mandatory
+			false,          // immediate
 			amqp.Publishing{
+				Headers:         headers,
 				ContentType:     "application/json",
 				ContentEncoding: "",
-				Body:            []byte(body),
+				DeliveryMode:    amqp.Persistent,
+				Type:            msg.Type,
+				Timestamp:       time.Unix(0, msg.Timestamp*int64(time.Millisecond)),
+				Body:            msg.Body,
 			})
-		failOnError(err, "Failed to publish transaction mq")
-
+		if err != nil {
+			p.Close()
+			return err
+		}
 	}
 
-}
-
-func UserAuditer(audits <-chan interface{}) {
-
-	//dump ur shit to the channel
 	var err error
-	rmqChannel, err = rmqConn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer rmqChannel.Close()
-
-	q, err := rmqChannel.QueueDeclare(
-		"user_queue", // name
-		false,        // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
+	timeout := time.After(publishConfirmTimeout)
+	for range batch {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				p.Close()
+				return errors.New("channel closed before confirm")
+			}
+			if !confirm.Ack {
+				//	keep reading so the next batch doesn't see these confirms
+				err = fmt.Errorf("%w: message nacked by broker", errAuditBatchRejected)
+			}
+		case <-timeout:
+			//	a late confirm would be read as the next batch's, start fresh
+			p.Close()
+			return errors.New("timed out waiting for confirm")
+		}
+	}
+	return err
+}
 
-	for auditStruct := range audits {
+// Drain the spool into the sink, one segment at a time, in batches. A
+// segment is only deleted once every record in it has been accepted or
+// dead-lettered. While the sink is unreachable we back off and keep our
+// place; a batch it rejects auditRejectAttempts times is dead-lettered so
+// it can't hold up everything behind it. Returns once stop is closed,
+// whatever is left stays spooled.
+func shipAudits(spool *Spool, sink AuditSink, stop <-chan struct{}) {
+	defer sink.Close()
+	backoff := publishMinBackoff
+	rejections := 0
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
 
-		body, merr := json.Marshal(auditStruct)
+		seq, ok := spool.Next()
+		if !ok {
+			select {
+			case <-spool.Ready():
+			case <-time.After(spoolPollInterval):
+			case <-stop:
+				return
+			}
+			continue
+		}
 
-		//dump that shit into rabbitmq
-		if merr != nil {
-			fmt.Println("marshal error")
+		records, err := spool.Read(seq)
+		if err != nil {
+			//	dropped by the overflow policy while we were busy
+			failGracefully(err, "Failed to read audit spool segment", "segment", seq)
+			spool.Remove(seq)
+			continue
 		}
 
-		err = rmqChannel.Publish(
-			"",     // exchange
-			q.Name, // routing key
-			false,  // mandatory
-			false,  // immediate
-			amqp.Publishing{
-				ContentType:     "application/json",
-				ContentEncoding: "",
-				Body:            []byte(body),
-			})
-		failOnError(err, "Failed to publish user mq")
+		batch := make([]AuditMessage, 0, auditBatchSize)
+		for shipped := 0; shipped < len(records); {
+			batch = batch[:0]
+			next := shipped
+			for ; next < len(records) && len(batch) < auditBatchSize; next++ {
+				msg, ok := routeAudit(records[next])
+				if !ok {
+					logger.Warn("No audit route", "type", records[next].Type)
+					continue
+				}
+				batch = append(batch, msg)
+			}
+
+			if len(batch) > 0 {
+				err = publishTraced(sink, batch)
+				if err != nil {
+					auditPublishFailures.Inc()
+				}
+				if errors.Is(err, errAuditBatchRejected) {
+					rejections++
+				}
+				if err != nil && rejections >= auditRejectAttempts {
+					logger.Error("Dead-lettering audit batch", "segment", seq, "batchSize", len(batch), "cause", err)
+					failGracefully(spool.DeadLetter(seq, records[shipped:next]), "Failed to dead-letter audit batch, skipping it", "segment", seq)
+					auditDeadLettered.Add(float64(len(batch)))
+					err = nil
+				}
+				if err != nil {
+					//	keep our place and wait for the sink to come back
+					failGracefully(err, "Failed to publish audit batch", "batchSize", len(batch), "retryIn", backoff.String())
+					select {
+					case <-time.After(backoff):
+					case <-stop:
+						return
+					}
+					backoff *= 2
+					if backoff > publishMaxBackoff {
+						backoff = publishMaxBackoff
+					}
+					continue
+				}
+				backoff = publishMinBackoff
+				rejections = 0
+			}
+			shipped = next
+		}
 
+		spool.Remove(seq)
 	}
 }
 
-func QuoteAuditer(audits <-chan interface{}) {
+//	Publish a batch under its own span, linked to the spans that raised
+//	each event, since the requests behind them have usually finished
+func publishTraced(sink AuditSink, batch []AuditMessage) error {
+	var links []trace.Link
+	for _, msg := range batch {
+		if sc := spanContextFromTraceParent(msg.TraceParent); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
 
-	var err error
-	rmqChannel, err = rmqConn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer rmqChannel.Close()
-
-	q, err := rmqChannel.QueueDeclare(
-		"quote_queue", // name
-		false,         // durable
-		false,         // delete when unused
-		false,         // exclusive
-		false,         // no-wait
-		nil,           // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
+	ctx, span := tracer.Start(context.Background(), "audit publish", trace.WithLinks(links...), trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	span.SetAttributes(attribute.Int("audit.batch_size", len(batch)))
 
-	for auditStruct := range audits {
+	err := sink.Publish(batch)
+	if err != nil {
+		spanError(ctx, err, "Failed to publish audit batch")
+	}
+	return err
+}
 
-		body, merr := json.Marshal(auditStruct)
+func rmqConnection() *amqp.Connection {
+	rmqMutex.RLock()
+	defer rmqMutex.RUnlock()
+	return rmqConn
+}
 
-		if merr != nil {
-			fmt.Println("marshal error")
+//	Redial whenever the broker drops us. Publishers pick up the new
+//	connection the next time they reopen their channel.
+func watchRMQ() {
+	for {
+		closed := rmqConnection().NotifyClose(make(chan *amqp.Error, 1))
+		reason, ok := <-closed
+		if !ok {
+			//	closed on purpose by us
+			return
+		}
+		logger.Warn("RabbitMQ connection lost", "cause", reason)
+
+		backoff := time.Second
+		for {
+			conn, err := amqp.Dial(config.rabbitMQ)
+			if err == nil {
+				rmqMutex.Lock()
+				rmqConn = conn
+				rmqMutex.Unlock()
+				logger.Info("Reconnected to RabbitMQ")
+				break
+			}
+			logger.Warn("RabbitMQ redial failed", "cause", err, "retryIn", backoff.String())
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
 		}
-
-		err = rmqChannel.Publish(
-			"",     // exchange
-			q.Name, // routing key
-			false,  // mandatory
-			false,  // immediate
-			amqp.Publishing{
-				ContentType:     "application/json",
-				ContentEncoding: "",
-				Body:            []byte(body),
-			})
-		failOnError(err, "Failed to publish user mq")
-
 	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//	Refuses everything, the way a broker nacking a batch would
+type rejectingSink struct {
+	mu       sync.Mutex
+	attempts int
+}
+
+func (r *rejectingSink) Publish(batch []AuditMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	return fmt.Errorf("%w: nacked", errAuditBatchRejected)
+}
+
+func (r *rejectingSink) Close() error {
+	return nil
+}
+
+//	Ships until the spool is empty, or fails the test
+func shipAll(t *testing.T, spool *Spool, sink AuditSink) {
+	t.Helper()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		shipAudits(spool, sink, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for spool.Size() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes still spooled", spool.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShipAuditsDeadLettersRejectedBatches(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openSpool(dir, 0, 1024*1024, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, spool, 3)
+
+	sink := &rejectingSink{}
+	shipAll(t, spool, sink)
+
+	if sink.attempts != auditRejectAttempts {
+		t.Errorf("batch offered %d times, want %d", sink.attempts, auditRejectAttempts)
+	}
+	deadSpool := &Spool{dir: filepath.Join(dir, deadLetterDir)}
+	records, err := deadSpool.Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Errorf("%d records dead-lettered, want 3", len(records))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// AuditMessage is one encoded audit event and where it should be delivered.
+type AuditMessage struct {
+	Type        string
+	Exchange    string
+	RoutingKey  string
+	Timestamp   int64
+	TraceParent string
+	Body        []byte
+}
+
+// AuditSink delivers batches of audit messages. Publish returns nil only
+// once every message in the batch is safely stored by the sink, so the
+// caller can throw away its own copy.
+type AuditSink interface {
+	Publish(batch []AuditMessage) error
+	Close() error
+}
+
+//	Everything is published to one topic exchange. Routing keys look like
+//	audit.user.BUY or audit.error.COMMIT_SELL so consumers can bind to
+//	exactly the events they care about.
+const auditExchange = "audit"
+
+type auditRoute struct {
+	Exchange string
+	Topic    string // routing key prefix, the event's key is appended
+	Queue    string // legacy queue bound to Topic.#, "" for routes only new consumers read
+}
+
+//	Audit struct name -> where it's published
+var auditRoutes = map[string]auditRoute{
+	"AccountTransaction": {Exchange: auditExchange, Topic: "audit.transaction", Queue: "transaction_queue"},
+	"SystemEvent":        {Exchange: auditExchange, Topic: "audit.system"},
+	"ErrorEvent":         {Exchange: auditExchange, Topic: "audit.error", Queue: "error_queue"},
+	"DebugEvent":         {Exchange: auditExchange, Topic: "audit.debug"},
+	"QuoteServer":        {Exchange: auditExchange, Topic: "audit.quote", Queue: "quote_queue"},
+	"UserCommand":        {Exchange: auditExchange, Topic: "audit.user", Queue: "user_queue"},
+}
+
+//	Build the message for a spooled event, false if nothing routes it
+func routeAudit(rec spoolRecord) (AuditMessage, bool) {
+	route, ok := auditRoutes[rec.Type]
+	if !ok {
+		return AuditMessage{}, false
+	}
+
+	routingKey := route.Topic
+	if rec.Key != "" {
+		routingKey += "." + rec.Key
+	}
+	return AuditMessage{Type: rec.Type, Exchange: route.Exchange, RoutingKey: routingKey, Timestamp: rec.Time, TraceParent: rec.Trace, Body: rec.Event}, true
+}
+
+//	Turn an event field into a single routing key word
+func routingWord(s string) string {
+	s = strings.NewReplacer(".", "_", "*", "_", "#", "_", " ", "_").Replace(s)
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// memorySink keeps everything it's given, for tests and local runs
+// without a broker.
+type memorySink struct {
+	mu       sync.Mutex
+	messages []AuditMessage
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{}
+}
+
+func (m *memorySink) Publish(batch []AuditMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, batch...)
+	return nil
+}
+
+func (m *memorySink) Close() error {
+	return nil
+}
+
+func (m *memorySink) Messages() []AuditMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]AuditMessage(nil), m.messages...)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRouteAudit(t *testing.T) {
+	tests := []struct {
+		eventType  string
+		key        string
+		routingKey string
+	}{
+		{"UserCommand", "BUY", "audit.user.BUY"},
+		{"ErrorEvent", "COMMIT_SELL", "audit.error.COMMIT_SELL"},
+		{"AccountTransaction", "add", "audit.transaction.add"},
+		{"SystemEvent", "", "audit.system"},
+		{"QuoteServer", routingWord("A.B"), "audit.quote.A_B"},
+	}
+	for _, test := range tests {
+		msg, ok := routeAudit(spoolRecord{Type: test.eventType, Key: test.key})
+		if !ok {
+			t.Errorf("%s not routed", test.eventType)
+			continue
+		}
+		if msg.Exchange != auditExchange || msg.RoutingKey != test.routingKey {
+			t.Errorf("%s %q routed to %s %s, want %s %s", test.eventType, test.key, msg.Exchange, msg.RoutingKey, auditExchange, test.routingKey)
+		}
+	}
+
+	if _, ok := routeAudit(spoolRecord{Type: "NoSuchEvent"}); ok {
+		t.Error("unknown event type routed")
+	}
+}
+
+func TestShipAuditsToMemorySink(t *testing.T) {
+	//	Small segments and more events than a batch holds, so order has to
+	//	survive both segment and batch boundaries
+	spool, err := openSpool(t.TempDir(), 0, 4096, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := 2*auditBatchSize + 10
+	appendEvents(t, spool, events)
+
+	sink := newMemorySink()
+	shipAll(t, spool, sink)
+
+	messages := sink.Messages()
+	if len(messages) != events {
+		t.Fatalf("shipped %d messages, want %d", len(messages), events)
+	}
+	for i, msg := range messages {
+		if msg.Type != "SystemEvent" || msg.RoutingKey != "audit.system.ADD" {
+			t.Fatalf("message %d is %s to %s", i, msg.Type, msg.RoutingKey)
+		}
+		var event SystemEvent
+		if err := json.Unmarshal(msg.Body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.TransactionNum != i+1 {
+			t.Fatalf("message %d has TransactionNum %d, want %d", i, event.TransactionNum, i+1)
+		}
+	}
+}
+
+//	Nothing would drain a queue for any other type, it would grow forever
+func TestOnlyLegacyQueuesDeclared(t *testing.T) {
+	legacy := map[string]string{
+		"AccountTransaction": "transaction_queue",
+		"ErrorEvent":         "error_queue",
+		"QuoteServer":        "quote_queue",
+		"UserCommand":        "user_queue",
+	}
+	for eventType, route := range auditRoutes {
+		if route.Queue != legacy[eventType] {
+			t.Errorf("%s declares queue %q, want %q", eventType, route.Queue, legacy[eventType])
+		}
+	}
+}
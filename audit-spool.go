@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//	What to do with a new event when the spool is full
+const (
+	overflowDropNewest = "drop-newest"
+	overflowDropOldest = "drop-oldest"
+	overflowBlock      = "block"
+)
+
+const spoolSuffix = ".jsonl"
+
+//	The longest block makes an event wait for room, it's dropped after that
+const spoolBlockTimeout = 2 * time.Second
+
+//	Where batches the sink keeps refusing are set aside, under the spool dir
+const deadLetterDir = "dead-letter"
+
+var errSpoolFull = errors.New("audit spool full")
+
+// A spooled audit event. Type is the audit struct name and Key the last
+// part of its routing key, together they decide where it's published.
+// Time is when it was spooled, in ms. Trace is the W3C traceparent of the
+// span that raised it, if any.
+type spoolRecord struct {
+	Type  string          `json:"type"`
+	Key   string          `json:"key,omitempty"`
+	Time  int64           `json:"time"`
+	Trace string          `json:"trace,omitempty"`
+	Event json.RawMessage `json:"event"`
+}
+
+// Spool is a write-ahead log of audit events, kept as numbered JSONL segment
+// files in dir. Handlers append to the newest segment; the shipper reads
+// sealed segments oldest first and deletes each one once everything in it
+// has been acknowledged.
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	overflow     string
+
+	mu          sync.Mutex
+	space       *sync.Cond
+	active      *os.File
+	activeSeq   int64
+	activeBytes int64
+	nextSeq     int64
+	seqs        []int64 // every segment on disk, active included, oldest first
+	size        int64
+	dropped     int64
+	ready       chan struct{}
+}
+
+func openSpool(dir string, maxBytes int64, segmentBytes int64, overflow string) (*Spool, error) {
+	switch overflow {
+	case overflowDropNewest, overflowDropOldest, overflowBlock:
+	default:
+		return nil, fmt.Errorf("unknown audit spool overflow policy %q", overflow)
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		overflow:     overflow,
+		ready:        make(chan struct{}, 1),
+	}
+	s.space = sync.NewCond(&s.mu)
+
+	//	Anything left over from a previous run is sealed and will be shipped first
+	seqs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		info, err := os.Stat(s.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.size += info.Size()
+		s.nextSeq = seq + 1
+	}
+	s.seqs = seqs
+
+	if len(seqs) > 0 {
+		s.notify()
+	}
+
+	return s, nil
+}
+
+func (s *Spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+//	Sequence numbers of every segment on disk, oldest first. Only read at
+//	open, after that the spool keeps track of its own segments.
+func (s *Spool) segments() ([]int64, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]int64, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *Spool) notify() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Append writes one event to the active segment, applying the overflow
+// policy if the spool is at its size limit. Under block it waits up to
+// spoolBlockTimeout for the shipper to make room, so a broker outage slows
+// trading down without stopping it.
+func (s *Spool) Append(eventType string, key string, traceparent string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//	Stamped under the lock so the spool is in timestamp order
+	eventTime := int64(time.Nanosecond) * int64(time.Now().UnixNano()) / int64(time.Millisecond)
+	line, err := json.Marshal(spoolRecord{Type: eventType, Key: key, Time: eventTime, Trace: traceparent, Event: body})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	var deadline time.Time
+	for s.maxBytes > 0 && s.size+int64(len(line)) > s.maxBytes {
+		switch s.overflow {
+		case overflowDropNewest:
+			s.dropped++
+			return errSpoolFull
+		case overflowDropOldest:
+			if !s.dropOldestLocked() {
+				s.dropped++
+				return errSpoolFull
+			}
+		case overflowBlock:
+			if deadline.IsZero() {
+				deadline = time.Now().Add(spoolBlockTimeout)
+				timer := time.AfterFunc(spoolBlockTimeout, func() {
+					s.mu.Lock()
+					s.space.Broadcast()
+					s.mu.Unlock()
+				})
+				defer timer.Stop()
+			}
+			if !time.Now().Before(deadline) {
+				s.dropped++
+				return errSpoolFull
+			}
+			s.space.Wait()
+		}
+	}
+
+	if s.active == nil || s.activeBytes >= s.segmentBytes {
+		err = s.rotateLocked()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.active.Write(line)
+	s.activeBytes += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if s.activeBytes >= s.segmentBytes {
+		s.notify()
+	}
+	return nil
+}
+
+//	Seal the active segment and start a new one
+func (s *Spool) rotateLocked() error {
+	s.sealLocked()
+
+	f, err := os.OpenFile(s.segmentPath(s.nextSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.activeSeq = s.nextSeq
+	s.activeBytes = 0
+	s.seqs = append(s.seqs, s.nextSeq)
+	s.nextSeq++
+	return nil
+}
+
+func (s *Spool) sealLocked() {
+	if s.active == nil {
+		return
+	}
+	s.active.Sync()
+	s.active.Close()
+	s.active = nil
+	s.notify()
+}
+
+//	Throw away the oldest sealed segment to make room. Drops whole segments,
+//	so the shipper may lose its place in one and move on to the next.
+func (s *Spool) dropOldestLocked() bool {
+	for _, seq := range append([]int64(nil), s.seqs...) {
+		if s.active != nil && seq == s.activeSeq {
+			continue
+		}
+		if s.removeLocked(seq) == nil {
+			s.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spool) removeLocked(seq int64) error {
+	//	Forgotten even if the file is already gone, or it'd be handed out forever
+	for i, listed := range s.seqs {
+		if listed == seq {
+			s.seqs = append(s.seqs[:i], s.seqs[i+1:]...)
+			break
+		}
+	}
+
+	path := s.segmentPath(seq)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	s.size -= info.Size()
+	s.space.Broadcast()
+	return nil
+}
+
+// Next returns the oldest sealed segment. If the shipper has caught up, the
+// active segment is sealed so its events don't wait for it to fill up.
+func (s *Spool) Next() (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seq := range s.seqs {
+		if s.active == nil || seq != s.activeSeq {
+			return seq, true
+		}
+	}
+
+	if s.active != nil && s.activeBytes > 0 {
+		seq := s.activeSeq
+		s.sealLocked()
+		return seq, true
+	}
+	return 0, false
+}
+
+// Read returns the records in a sealed segment. A torn last line from a
+// crash mid-write is skipped.
+func (s *Spool) Read(seq int64) ([]spoolRecord, error) {
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []spoolRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec spoolRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			failGracefully(err, "Skipping corrupt audit spool record")
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Last returns the newest record in the spool, if there is one.
+func (s *Spool) Last() (spoolRecord, bool) {
+	s.mu.Lock()
+	seqs := append([]int64(nil), s.seqs...)
+	s.mu.Unlock()
+
+	for i := len(seqs) - 1; i >= 0; i-- {
+		records, err := s.Read(seqs[i])
+		if err == nil && len(records) > 0 {
+			return records[len(records)-1], true
+		}
+	}
+	return spoolRecord{}, false
+}
+
+// DeadLetter sets aside records from segment seq that the sink keeps
+// refusing, so they stop holding up the rest. They're kept in the
+// dead-letter directory in spool format, to be looked at or re-spooled by
+// hand, and don't count towards the spool's size.
+func (s *Spool) DeadLetter(seq int64, records []spoolRecord) error {
+	dir := filepath.Join(s.dir, deadLetterDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", seq, spoolSuffix)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Remove deletes a segment once all of its records have been acknowledged.
+func (s *Spool) Remove(seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeLocked(seq)
+}
+
+// Size is the number of bytes of events waiting to be shipped.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Dropped counts events refused and segments discarded by the overflow policy.
+func (s *Spool) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Ready fires when there may be a sealed segment to ship.
+func (s *Spool) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealLocked()
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func appendEvent(spool *Spool, transactionNum int) error {
+	event := SystemEvent{Server: "test", Command: "ADD", Username: "user", TransactionNum: transactionNum}
+	return spool.Append("SystemEvent", "ADD", "", event)
+}
+
+func appendEvents(t *testing.T, spool *Spool, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := appendEvent(spool, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//	Ship everything left, returning the transactions in the order shipped
+func drain(t *testing.T, spool *Spool) []int {
+	t.Helper()
+	var shipped []int
+	for {
+		seq, ok := spool.Next()
+		if !ok {
+			return shipped
+		}
+		records, err := spool.Read(seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range records {
+			var event SystemEvent
+			json.Unmarshal(rec.Event, &event)
+			shipped = append(shipped, event.TransactionNum)
+		}
+		spool.Remove(seq)
+	}
+}
+
+//	A spool with room for three single digit events, one per segment
+func fullSpool(t *testing.T, overflow string) *Spool {
+	t.Helper()
+	sizer, err := openSpool(t.TempDir(), 0, 1, overflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, sizer, 1)
+	sizer.Close()
+
+	spool, err := openSpool(t.TempDir(), 3*sizer.Size(), 1, overflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, spool, 3)
+	return spool
+}
+
+func TestSpoolTracksSegments(t *testing.T) {
+	spool, err := openSpool(t.TempDir(), 0, 1, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//	One event per segment
+	appendEvents(t, spool, 3)
+
+	for want := int64(0); want < 3; want++ {
+		seq, ok := spool.Next()
+		if !ok || seq != want {
+			t.Fatalf("Next() = %d, %v, want %d", seq, ok, want)
+		}
+		if err := spool.Remove(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seq, ok := spool.Next(); ok {
+		t.Fatalf("Next() = %d after everything was removed", seq)
+	}
+	if size := spool.Size(); size != 0 {
+		t.Fatalf("Size() = %d, want 0", size)
+	}
+}
+
+func TestSpoolForgetsVanishedSegments(t *testing.T) {
+	spool, err := openSpool(t.TempDir(), 0, 1, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, spool, 2)
+
+	os.Remove(spool.segmentPath(0))
+	spool.Remove(0)
+	if seq, ok := spool.Next(); !ok || seq != 1 {
+		t.Fatalf("Next() = %d, %v, want 1", seq, ok)
+	}
+}
+
+func TestSpoolReopensLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openSpool(dir, 0, 1, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, spool, 2)
+	spool.Close()
+
+	reopened, err := openSpool(dir, 0, 1, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, reopened, 1)
+	var seqs []int64
+	for {
+		seq, ok := reopened.Next()
+		if !ok {
+			break
+		}
+		seqs = append(seqs, seq)
+		reopened.Remove(seq)
+	}
+	if len(seqs) != 3 || seqs[0] != 0 || seqs[1] != 1 || seqs[2] != 2 {
+		t.Fatalf("shipped segments %v, want [0 1 2]", seqs)
+	}
+}
+
+func TestSpoolLast(t *testing.T) {
+	spool, err := openSpool(t.TempDir(), 0, 1, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spool.Last(); ok {
+		t.Fatal("Last() found a record in an empty spool")
+	}
+	appendEvents(t, spool, 3)
+
+	rec, ok := spool.Last()
+	var event SystemEvent
+	if ok {
+		json.Unmarshal(rec.Event, &event)
+	}
+	if event.TransactionNum != 3 {
+		t.Fatalf("Last() = transaction %d, %v, want 3", event.TransactionNum, ok)
+	}
+}
+
+func TestSpoolDropsNewest(t *testing.T) {
+	spool := fullSpool(t, overflowDropNewest)
+
+	if err := appendEvent(spool, 4); err != errSpoolFull {
+		t.Fatalf("Append() = %v, want %v", err, errSpoolFull)
+	}
+	if dropped := spool.Dropped(); dropped != 1 {
+		t.Fatalf("Dropped() = %d, want 1", dropped)
+	}
+	if shipped := drain(t, spool); !reflect.DeepEqual(shipped, []int{1, 2, 3}) {
+		t.Fatalf("shipped %v, want [1 2 3]", shipped)
+	}
+}
+
+func TestSpoolDropsOldest(t *testing.T) {
+	spool := fullSpool(t, overflowDropOldest)
+
+	if err := appendEvent(spool, 4); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := spool.Dropped(); dropped != 1 {
+		t.Fatalf("Dropped() = %d, want 1", dropped)
+	}
+	if shipped := drain(t, spool); !reflect.DeepEqual(shipped, []int{2, 3, 4}) {
+		t.Fatalf("shipped %v, want [2 3 4]", shipped)
+	}
+}
+
+func TestSpoolBlocksUntilThereIsRoom(t *testing.T) {
+	spool := fullSpool(t, overflowBlock)
+
+	appended := make(chan error)
+	go func() { appended <- appendEvent(spool, 4) }()
+	select {
+	case err := <-appended:
+		t.Fatalf("Append() = %v on a full spool, want it to wait", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	seq, _ := spool.Next()
+	spool.Remove(seq)
+	if err := <-appended; err != nil {
+		t.Fatal(err)
+	}
+	if dropped := spool.Dropped(); dropped != 0 {
+		t.Fatalf("Dropped() = %d, want 0", dropped)
+	}
+	if shipped := drain(t, spool); !reflect.DeepEqual(shipped, []int{2, 3, 4}) {
+		t.Fatalf("shipped %v, want [2 3 4]", shipped)
+	}
+}
+
+func TestSpoolBlocksForAWhileAtMost(t *testing.T) {
+	spool := fullSpool(t, overflowBlock)
+
+	start := time.Now()
+	if err := appendEvent(spool, 4); err != errSpoolFull {
+		t.Fatalf("Append() = %v, want %v", err, errSpoolFull)
+	}
+	if waited := time.Since(start); waited < spoolBlockTimeout {
+		t.Fatalf("gave up after %s, want %s", waited, spoolBlockTimeout)
+	}
+	if dropped := spool.Dropped(); dropped != 1 {
+		t.Fatalf("Dropped() = %d, want 1", dropped)
+	}
+	if shipped := drain(t, spool); !reflect.DeepEqual(shipped, []int{1, 2, 3}) {
+		t.Fatalf("shipped %v, want [1 2 3]", shipped)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	xmlLogHeader = "<?xml version=\"1.0\"?>\n<log>\n"
+	xmlLogFooter = "</log>\n"
+)
+
+//	Commands allowed by the course logfile schema
+var logfileCommands = map[string]bool{
+	"ADD": true, "QUOTE": true, "BUY": true, "COMMIT_BUY": true, "CANCEL_BUY": true,
+	"SELL": true, "COMMIT_SELL": true, "CANCEL_SELL": true,
+	"SET_BUY_AMOUNT": true, "CANCEL_SET_BUY": true, "SET_BUY_TRIGGER": true,
+	"SET_SELL_AMOUNT": true, "SET_SELL_TRIGGER": true, "CANCEL_SET_SELL": true,
+	"DUMPLOG": true, "DISPLAY_SUMMARY": true,
+}
+
+//	Logfile elements. Field order is the order the schema requires.
+type xmlUserCommand struct {
+	XMLName        xml.Name `xml:"userCommand"`
+	Timestamp      int64    `xml:"timestamp"`
+	Server         string   `xml:"server"`
+	TransactionNum int      `xml:"transactionNum"`
+	Command        string   `xml:"command"`
+	Username       string   `xml:"username,omitempty"`
+	StockSymbol    string   `xml:"stockSymbol,omitempty"`
+	Filename       string   `xml:"filename,omitempty"`
+	Funds          string   `xml:"funds,omitempty"`
+}
+
+type xmlQuoteServer struct {
+	XMLName         xml.Name `xml:"quoteServer"`
+	Timestamp       int64    `xml:"timestamp"`
+	Server          string   `xml:"server"`
+	TransactionNum  int      `xml:"transactionNum"`
+	Price           string   `xml:"price"`
+	StockSymbol     string   `xml:"stockSymbol"`
+	Username        string   `xml:"username"`
+	QuoteServerTime int64    `xml:"quoteServerTime"`
+	Cryptokey       string   `xml:"cryptokey"`
+}
+
+type xmlAccountTransaction struct {
+	XMLName        xml.Name `xml:"accountTransaction"`
+	Timestamp      int64    `xml:"timestamp"`
+	Server         string   `xml:"server"`
+	TransactionNum int      `xml:"transactionNum"`
+	Action         string   `xml:"action"`
+	Username       string   `xml:"username"`
+	Funds          string   `xml:"funds"`
+}
+
+//	systemEvent, errorEvent and debugEvent share a layout
+type xmlEvent struct {
+	XMLName        xml.Name
+	Timestamp      int64  `xml:"timestamp"`
+	Server         string `xml:"server"`
+	TransactionNum int    `xml:"transactionNum"`
+	Command        string `xml:"command"`
+	Username       string `xml:"username,omitempty"`
+	StockSymbol    string `xml:"stockSymbol,omitempty"`
+	Filename       string `xml:"filename,omitempty"`
+	Funds          string `xml:"funds,omitempty"`
+	ErrorMessage   string `xml:"errorMessage,omitempty"`
+	DebugMessage   string `xml:"debugMessage,omitempty"`
+}
+
+//	Our amounts are in cents, the logfile wants dollars
+func centsToDollars(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = 0 - cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+//	Turn a published audit message back into its logfile element
+func logfileElement(msg AuditMessage) (interface{}, error) {
+	switch msg.Type {
+	case "UserCommand":
+		var e UserCommand
+		if err := json.Unmarshal(msg.Body, &e); err != nil {
+			return nil, err
+		}
+		return xmlUserCommand{Timestamp: msg.Timestamp, Server: e.Server, TransactionNum: e.TransactionNum, Command: e.Command, Username: e.Username, StockSymbol: e.StockSymbol, Filename: e.Filename, Funds: centsToDollars(e.Funds)}, nil
+
+	case "QuoteServer":
+		var e QuoteServer
+		if err := json.Unmarshal(msg.Body, &e); err != nil {
+			return nil, err
+		}
+		return xmlQuoteServer{Timestamp: msg.Timestamp, Server: e.Server, TransactionNum: e.TransactionNum, Price: centsToDollars(e.Price), StockSymbol: e.StockSymbol, Username: e.Username, QuoteServerTime: e.QuoteServerTime, Cryptokey: e.Cryptokey}, nil
+
+	case "AccountTransaction":
+		var e AccountTransaction
+		if err := json.Unmarshal(msg.Body, &e); err != nil {
+			return nil, err
+		}
+		return xmlAccountTransaction{Timestamp: msg.Timestamp, Server: e.Server, TransactionNum: e.TransactionNum, Action: e.Action, Username: e.Username, Funds: centsToDollars(e.Funds)}, nil
+
+	case "SystemEvent":
+		var e SystemEvent
+		if err := json.Unmarshal(msg.Body, &e); err != nil {
+			return nil, err
+		}
+		return xmlEvent{XMLName: xml.Name{Local: "systemEvent"}, Timestamp: msg.Timestamp, Server: e.Server, TransactionNum: e.TransactionNum, Command: e.Command, Username: e.Username, StockSymbol: e.StockSymbol, Filename: e.Filename, Funds: centsToDollars(e.Funds)}, nil
+
+	case "ErrorEvent":
+		var e ErrorEvent
+		if err := json.Unmarshal(msg.Body, &e); err != nil {
+			return nil, err
+		}
+		return xmlEvent{XMLName: xml.Name{Local: "errorEvent"}, Timestamp: msg.Timestamp, Server: e.Server, TransactionNum: e.TransactionNum, Command: e.Command, Username: e.Username, StockSymbol: e.StockSymbol, Filename: e.Filename, Funds: centsToDollars(e.Funds), ErrorMessage: e.ErrorMessage}, nil
+
+	case "DebugEvent":
+		var e DebugEvent
+		if err := json.Unmarshal(msg.Body, &e); err != nil {
+			return nil, err
+		}
+		return xmlEvent{XMLName: xml.Name{Local: "debugEvent"}, Timestamp: msg.Timestamp, Server: e.Server, TransactionNum: e.TransactionNum, Command: e.Command, Username: e.Username, StockSymbol: e.StockSymbol, Filename: e.Filename, Funds: centsToDollars(e.Funds), DebugMessage: e.DebugMessage}, nil
+	}
+
+	return nil, errors.New("no logfile element for " + msg.Type)
+}
+
+//	Whether the element can appear in a schema-valid logfile
+func validLogfileElement(element interface{}) bool {
+	switch e := element.(type) {
+	case xmlUserCommand:
+		return logfileCommands[e.Command] && e.TransactionNum > 0
+	case xmlEvent:
+		return logfileCommands[e.Command] && e.TransactionNum > 0
+	case xmlAccountTransaction:
+		return e.TransactionNum > 0
+	case xmlQuoteServer:
+		return e.TransactionNum > 0
+	}
+	return false
+}
+
+// xmlLogSink writes audit events straight to a course format logfile, for
+// runs without the audit server. Events are written in the order they were
+// spooled, which is also timestamp order.
+type xmlLogSink struct {
+	file *os.File
+}
+
+// Opens (or continues) the logfile at path. The closing </log> is
+// stripped from an existing file and written again on Close.
+func newXMLLogSink(path string) (*xmlLogSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		_, err = f.WriteString(xmlLogHeader)
+	} else {
+		err = stripXMLLogFooter(f, info.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &xmlLogSink{file: f}, nil
+}
+
+func stripXMLLogFooter(f *os.File, size int64) error {
+	tailSize := int64(len(xmlLogFooter))
+	if size < tailSize {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	_, err := f.ReadAt(tail, size-tailSize)
+	if err != nil {
+		return err
+	}
+
+	end := size
+	if i := bytes.LastIndex(tail, []byte("</log>")); i >= 0 {
+		end = size - tailSize + int64(i)
+		err = f.Truncate(end)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = f.Seek(end, io.SeekStart)
+	return err
+}
+
+func (x *xmlLogSink) Publish(batch []AuditMessage) error {
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent(" ", "  ")
+
+	for _, msg := range batch {
+		element, err := logfileElement(msg)
+		if err != nil {
+			failGracefully(err, "Skipping audit event for logfile", "type", msg.Type)
+			continue
+		}
+		if !validLogfileElement(element) {
+			logger.Warn("Skipping audit event the logfile schema doesn't allow", "type", msg.Type, "event", string(msg.Body))
+			continue
+		}
+		err = encoder.Encode(element)
+		if err != nil {
+			return err
+		}
+	}
+	encoder.Flush()
+	if buf.Len() == 0 {
+		return nil
+	}
+	buf.WriteByte('\n')
+
+	_, err := x.file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return x.file.Sync()
+}
+
+func (x *xmlLogSink) Close() error {
+	_, err := x.file.WriteString(xmlLogFooter)
+	if err != nil {
+		x.file.Close()
+		return err
+	}
+	return x.file.Close()
+}
+
+// teeSink publishes every batch to several sinks. If one fails, the
+// shipper retries the same batch and only the sinks that haven't
+// accepted it yet see it again.
+type teeSink struct {
+	sinks []AuditSink
+	done  []bool
+}
+
+func newTeeSink(sinks ...AuditSink) *teeSink {
+	return &teeSink{sinks: sinks, done: make([]bool, len(sinks))}
+}
+
+func (t *teeSink) Publish(batch []AuditMessage) error {
+	for i, sink := range t.sinks {
+		if t.done[i] {
+			continue
+		}
+		err := sink.Publish(batch)
+		if err != nil {
+			return err
+		}
+		t.done[i] = true
+	}
+
+	for i := range t.done {
+		t.done[i] = false
+	}
+	return nil
+}
+
+func (t *teeSink) Close() error {
+	var err error
+	for _, sink := range t.sinks {
+		if cerr := sink.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	//	Bigger workloads go in several batches
+	maxBatchCommands = 10000
+	maxBatchBytes    = 8 * 1024 * 1024
+
+	//	Users whose commands run at once, so a batch can't swamp the quote server and postgres
+	batchParallelUsers = 16
+)
+
+// Each command is the body its handler takes, plus which command it is:
+// {"Command": "ADD", "UserId": "oY01WVirLr", "Amount": 6351153, "TransactionNum": 1}
+type BatchRequest struct {
+	Commands []json.RawMessage
+}
+
+// One result per command, in the order they were sent. Response is the
+// command's own response body, if it has one: JSON as is, anything else
+// (a dumped XML log) as a string.
+type BatchResult struct {
+	Command  string
+	UserId   string
+	Status   int
+	Error    *ErrorResponse  `json:",omitempty"`
+	Response json.RawMessage `json:",omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult
+}
+
+// Runs a batch of commands. Each user's commands run one after another in
+// the order given, up to batchParallelUsers users' at once. A command
+// without a user (a DUMPLOG of everything) waits for everything before it
+// and holds up everything after, so a closing DUMPLOG sees the whole batch.
+// A failed command doesn't stop the ones after it.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, errMethodNotAllowed.withMessage(r.Method+" not allowed on /batch"), 0)
+		return
+	}
+
+	var req BatchRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, errRequestTooLarge.withMessage("batch bigger than "+strconv.Itoa(maxBatchBytes)+" bytes"), 0)
+		return
+	}
+	if err != nil {
+		writeError(w, errBadRequest.withMessage("malformed batch: "+err.Error()), 0)
+		return
+	}
+	if len(req.Commands) > maxBatchCommands {
+		writeError(w, errBadRequest.withMessage("more than "+strconv.Itoa(maxBatchCommands)+" commands in one batch"), 0)
+		return
+	}
+
+	//	Commands join the batch's trace, so only the workload file carries over
+	workload := r.Header.Get(workloadFileHeader)
+
+	results := make([]BatchResult, len(req.Commands))
+	userIds := make([]string, len(req.Commands))
+	users := map[string]bool{}
+	for i, body := range req.Commands {
+		ids := struct {
+			Command string
+			UserId  string
+		}{}
+		json.Unmarshal(body, &ids)
+		results[i] = BatchResult{Command: strings.ToUpper(ids.Command), UserId: ids.UserId}
+		userIds[i] = ids.UserId
+		if ids.UserId != "" {
+			users[ids.UserId] = true
+		}
+	}
+
+	inUserOrder(userIds, batchParallelUsers, func(i int) {
+		commandReq, decodeErr := jsonRequest(results[i].Command, bytes.NewReader(req.Commands[i]))
+		resp, err := runCommand(ctx, results[i].Command, commandReq, decodeErr, workload)
+		if err == nil {
+			results[i].Response, err = batchResponse(resp)
+		}
+
+		results[i].Status = http.StatusOK
+		if err != nil {
+			apiErr := asAPIError(err)
+			_, transactionNum := requestIds(commandReq)
+			results[i].Status = apiErr.Status
+			results[i].Error = &ErrorResponse{Code: apiErr.Code, Message: apiErr.Message, TransactionNum: transactionNum}
+		}
+	})
+
+	logFor(ctx).Info("Ran batch", "commands", len(req.Commands), "users", len(users))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchResponse{Results: results})
+}
+
+//	A command's response as it goes in a BatchResult, nil if it only has a status
+func batchResponse(resp interface{}) (json.RawMessage, error) {
+	switch resp := resp.(type) {
+	case CommandResponse:
+		return nil, nil
+	case *dumpedLog:
+		defer resp.Body.Close()
+		plain, err := resp.plain()
+		var log []byte
+		if err == nil {
+			log, err = ioutil.ReadAll(plain)
+		}
+		if err != nil {
+			return nil, errAuditUnavailable.withMessage("unreadable dumplog").because(err)
+		}
+		if strings.HasPrefix(resp.ContentType, "application/json") && json.Valid(log) {
+			return log, nil
+		}
+		return json.Marshal(string(log))
+	}
+	return json.Marshal(resp)
+}
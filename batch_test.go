@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchRejectsOversizedBody(t *testing.T) {
+	body := `{"Commands": [` + strings.Repeat(" ", maxBatchBytes) + `]}`
+	w := httptest.NewRecorder()
+	batchHandler(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	var failure ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &failure)
+	if failure.Code != errRequestTooLarge.Code {
+		t.Errorf("code %q, want %q", failure.Code, errRequestTooLarge.Code)
+	}
+}
+
+func TestBatchRejectsTooManyCommands(t *testing.T) {
+	commands := make([]json.RawMessage, maxBatchCommands+1)
+	for i := range commands {
+		commands[i] = json.RawMessage(`{}`)
+	}
+	body, _ := json.Marshal(BatchRequest{Commands: commands})
+	w := httptest.NewRecorder()
+	batchHandler(w, httptest.NewRequest("POST", "/batch", bytes.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+//	A batch is allowed far more than a single command, as main serves it
+func TestRegisteredBatchTakesMoreThanACommand(t *testing.T) {
+	mux := http.NewServeMux()
+	if err := registerRoutes(mux); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"Commands": [], "Padding": "` + strings.Repeat("a", 2*maxCommandBytes) + `"}`
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+}
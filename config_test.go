@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPostgresCredentialsRequired(t *testing.T) {
+	t.Setenv("TX_CONFIG_FILE", "")
+	t.Setenv("TX_POSTGRES_USER", "")
+	t.Setenv("TX_POSTGRES_PASSWORD", "")
+
+	_, err := loadConfig(nil)
+	if err == nil {
+		t.Fatal("config without postgres credentials accepted")
+	}
+	for _, want := range []string{"postgres-user is required", "postgres-password is required"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't say %q", err, want)
+		}
+	}
+
+	t.Setenv("TX_POSTGRES_USER", "moonshot")
+	c, err := loadConfig([]string{"-postgres-password", "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.dbUser != "moonshot" || c.dbPassword != "secret" {
+		t.Errorf("got postgres user %q password %q", c.dbUser, c.dbPassword)
+	}
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	t.Setenv("TX_CONFIG_FILE", "")
+	t.Setenv("TX_POSTGRES_USER", "")
+	t.Setenv("TX_POSTGRES_PASSWORD", "")
+	files := map[string]string{
+		"config.yaml": "postgres-user: moonshot\npostgres-password: hodl\nport: \":45000\"\naudit-spool-max-bytes: 8388608\n",
+		"config.toml": "postgres-user = \"moonshot\"\npostgres-password = \"hodl\"\nport = \":45000\"\naudit-spool-max-bytes = 8388608\n",
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadConfig([]string{"-config", path})
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if c.dbUser != "moonshot" || c.dbPassword != "hodl" || c.port != ":45000" || c.auditSpoolMaxBytes != 8388608 {
+			t.Errorf("%s: got user %q password %q port %q audit-spool-max-bytes %d", name, c.dbUser, c.dbPassword, c.port, c.auditSpoolMaxBytes)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// apiError is an error a client can act on. Code is stable and machine
+// readable, Status is the HTTP status it's reported with and Message, if
+// set, says what went wrong in more detail than the handler knows.
+type apiError struct {
+	Code    string
+	Status  int
+	Message string
+	Cause   error
+}
+
+func (e *apiError) Error() string {
+	msg := e.Code
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Cause
+}
+
+//	Errors with the same code match, whatever caused them
+func (e *apiError) Is(target error) bool {
+	t, ok := target.(*apiError)
+	return ok && t.Code == e.Code
+}
+
+//	A copy of e, caused by cause
+func (e *apiError) because(cause error) *apiError {
+	c := *e
+	c.Cause = cause
+	return &c
+}
+
+//	A copy of e, reported with a different status
+func (e *apiError) withStatus(status int) *apiError {
+	c := *e
+	c.Status = status
+	return &c
+}
+
+//	A copy of e, explained by msg
+func (e *apiError) withMessage(msg string) *apiError {
+	c := *e
+	c.Message = msg
+	return &c
+}
+
+var (
+	errBadRequest         = &apiError{Code: "BAD_REQUEST", Status: http.StatusBadRequest}
+	errRequestTooLarge    = &apiError{Code: "REQUEST_TOO_LARGE", Status: http.StatusRequestEntityTooLarge}
+	errInvalidSymbol      = &apiError{Code: "INVALID_SYMBOL", Status: http.StatusBadRequest}
+	errInvalidAmount      = &apiError{Code: "INVALID_AMOUNT", Status: http.StatusBadRequest}
+	errInvalidUser        = &apiError{Code: "INVALID_USER", Status: http.StatusBadRequest, Message: "UserId must be 1 to 20 letters, digits, _ or -"}
+	errInvalidTransaction = &apiError{Code: "INVALID_TRANSACTION_NUM", Status: http.StatusBadRequest}
+	errNoPendingBuy       = &apiError{Code: "NO_PENDING_BUY", Status: http.StatusBadRequest}
+	errNoPendingSell      = &apiError{Code: "NO_PENDING_SELL", Status: http.StatusBadRequest}
+	errNoBuyTrigger       = &apiError{Code: "NO_BUY_TRIGGER", Status: http.StatusBadRequest}
+	errNoSellTrigger      = &apiError{Code: "NO_SELL_TRIGGER", Status: http.StatusBadRequest}
+	errInsufficientFunds  = &apiError{Code: "INSUFFICIENT_FUNDS", Status: http.StatusBadRequest, Message: "insufficient funds"}
+	errInsufficientStocks = &apiError{Code: "INSUFFICIENT_STOCKS", Status: http.StatusBadRequest, Message: "insufficient stocks"}
+	errLedgerUnavailable  = &apiError{Code: "LEDGER_UNAVAILABLE", Status: http.StatusInternalServerError, Message: "ledger unavailable"}
+	errQuoteUnavailable   = &apiError{Code: "QUOTE_UNAVAILABLE", Status: http.StatusBadGateway, Message: "quote server unavailable"}
+	errInvalidQuote       = &apiError{Code: "INVALID_QUOTE", Status: http.StatusBadGateway, Message: "invalid quote"}
+	errAuditUnavailable   = &apiError{Code: "AUDIT_UNAVAILABLE", Status: http.StatusBadGateway}
+	errAuditRejected      = &apiError{Code: "AUDIT_REJECTED", Status: http.StatusBadRequest}
+	errInternal           = &apiError{Code: "INTERNAL", Status: http.StatusInternalServerError}
+)
+
+//	The apiError in err's chain, anything else is our fault
+func asAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return errInternal.because(err)
+}
+
+// Audits and logs a failed command, and returns what to report. The
+// report's message is the ErrorEvent's, with the error's own detail
+// appended to both.
+func commandFailed(ctx context.Context, err error, auditError ErrorEvent) error {
+	apiErr := asAPIError(err)
+	if apiErr.Message != "" {
+		auditError.ErrorMessage += ": " + apiErr.Message
+	}
+
+	//	The caller's mistake is a warning, ours is an error
+	log := logFor(ctx).Warn
+	if apiErr.Status >= 500 {
+		log = logFor(ctx).Error
+	}
+	log(auditError.ErrorMessage, "code", apiErr.Code, "status", apiErr.Status, "cause", apiErr.Cause)
+	spanError(ctx, err, auditError.ErrorMessage)
+	audit(ctx, auditError)
+	if auditError.Username != "" {
+		accountEvents.Publish(AccountEvent{Type: eventCommandFailed, UserId: auditError.Username, Command: auditError.Command, Code: apiErr.Code, TransactionNum: auditError.TransactionNum})
+	}
+
+	return apiErr.withMessage(auditError.ErrorMessage)
+}
+
+//	The error response on its own, for failures that aren't a command's
+func writeError(w http.ResponseWriter, apiErr *apiError, transactionNum int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: apiErr.Code, Message: apiErr.Message, TransactionNum: transactionNum})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//	Account event types
+const (
+	eventFundsChanged = "FUNDS_CHANGED"
+
+	eventBuyPending   = "BUY_PENDING"
+	eventBuyCommitted = "BUY_COMMITTED"
+	eventBuyCancelled = "BUY_CANCELLED"
+	eventBuyExpired   = "BUY_EXPIRED"
+
+	eventSellPending   = "SELL_PENDING"
+	eventSellCommitted = "SELL_COMMITTED"
+	eventSellCancelled = "SELL_CANCELLED"
+	eventSellExpired   = "SELL_EXPIRED"
+
+	eventBuyTriggerSet        = "BUY_TRIGGER_SET"
+	eventBuyTriggerFilled     = "BUY_TRIGGER_FILLED"
+	eventBuyTriggerCancelled  = "BUY_TRIGGER_CANCELLED"
+	eventSellTriggerSet       = "SELL_TRIGGER_SET"
+	eventSellTriggerFilled    = "SELL_TRIGGER_FILLED"
+	eventSellTriggerCancelled = "SELL_TRIGGER_CANCELLED"
+
+	eventCommandFailed = "COMMAND_FAILED"
+)
+
+// Something that happened to a user's account. Amount is in cents: the
+// change in funds, or what an order or trigger is for, cost or made. Price
+// is the quote an order was made or filled at, or a trigger's price.
+// Quantity is in stocks. A COMMAND_FAILED event names the Command and the
+// error Code it failed with. Fields are only ever appended, they double as
+// the gRPC message.
+type AccountEvent struct {
+	Type           string
+	UserId         string
+	StockSymbol    string
+	Amount         int
+	Price          int
+	TransactionNum int
+	Timestamp      int64
+	Quantity       int
+	Command        string
+	Code           string
+}
+
+//	Slow subscribers miss events rather than hold up trading
+const eventBuffer = 64
+
+// Fans account events out to whoever is watching that user. There is no
+// history, a subscriber only sees what happens after it subscribes.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan AccountEvent]bool
+}
+
+var accountEvents = &eventBroker{subscribers: map[string]map[chan AccountEvent]bool{}}
+
+//	Events for userId until cancel is called
+func (b *eventBroker) Subscribe(userId string) (<-chan AccountEvent, func()) {
+	ch := make(chan AccountEvent, eventBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[userId] == nil {
+		b.subscribers[userId] = map[chan AccountEvent]bool{}
+	}
+	b.subscribers[userId][ch] = true
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		delete(b.subscribers[userId], ch)
+		if len(b.subscribers[userId]) == 0 {
+			delete(b.subscribers, userId)
+		}
+		b.mu.Unlock()
+	}
+	return ch, cancel
+}
+
+func (b *eventBroker) Publish(event AccountEvent) {
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.UserId] {
+		select {
+		case ch <- event:
+		default:
+			eventsDropped.Inc()
+		}
+	}
+}
+
+//	A comment line this often keeps proxies from closing idle streams
+const eventKeepAlive = 30 * time.Second
+
+//	Not a command as such, it's neither recorded nor batched
+const accountEventsPath = "/v1/users/{user}/events"
+
+//	Closed on shutdown, so event streams end instead of holding it up
+var eventStreamsStopping = make(chan struct{})
+
+// Streams the user's account events as server-sent events, named by their
+// Type with the AccountEvent as JSON data, until the client hangs up.
+func accountEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	decoder := json.NewDecoder(r.Body)
+	req := UserRequest{TransactionNum: 1}
+
+	err := decoder.Decode(&req)
+	err = checkRequest("WATCH_ACCOUNT", err, commandRequest{UserId: req.UserId, TransactionNum: req.TransactionNum})
+	if err != nil {
+		apiErr := asAPIError(err)
+		logFor(ctx).Warn("Bad Request", "code", apiErr.Code, "cause", apiErr.Cause)
+		writeError(w, apiErr, req.TransactionNum)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errInternal.withMessage("streaming unsupported"), req.TransactionNum)
+		return
+	}
+
+	events, cancel := accountEvents.Subscribe(req.UserId)
+	defer cancel()
+	logFor(ctx).Info("Watching account", "user", req.UserId)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		case <-eventStreamsStopping:
+			return
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	grpcPackage = "moonshot.transaction.v1"
+	grpcService = grpcPackage + ".TransactionService"
+)
+
+//	A piece of a dumped log, ContentType is only set on the first
+type DumpLogResponse struct {
+	ContentType string
+	Log         []byte
+}
+
+//	DumpLog sends the log on in pieces this big
+const dumpLogChunkBytes = 64 * 1024
+
+//	The unary RPCs, each runs its command
+var grpcMethods = []struct {
+	name     string
+	command  string
+	response interface{}
+}{
+	{"Quote", "QUOTE", QuoteResponse{}},
+	{"Add", "ADD", CommandResponse{}},
+	{"Buy", "BUY", CommandResponse{}},
+	{"CommitBuy", "COMMIT_BUY", CommandResponse{}},
+	{"CancelBuy", "CANCEL_BUY", CommandResponse{}},
+	{"Sell", "SELL", CommandResponse{}},
+	{"CommitSell", "COMMIT_SELL", CommandResponse{}},
+	{"CancelSell", "CANCEL_SELL", CommandResponse{}},
+	{"SetBuyAmount", "SET_BUY_AMOUNT", CommandResponse{}},
+	{"CancelSetBuy", "CANCEL_SET_BUY", CommandResponse{}},
+	{"SetBuyTrigger", "SET_BUY_TRIGGER", CommandResponse{}},
+	{"SetSellAmount", "SET_SELL_AMOUNT", CommandResponse{}},
+	{"CancelSetSell", "CANCEL_SET_SELL", CommandResponse{}},
+	{"SetSellTrigger", "SET_SELL_TRIGGER", CommandResponse{}},
+	{"DisplaySummary", "DISPLAY_SUMMARY", CommandResponse{}},
+}
+
+var (
+	grpcServer   *grpc.Server
+	grpcStopping = make(chan struct{})
+)
+
+// Serves the gRPC service on config.grpcPort, if there is one. Server
+// reflection is on, so grpcurl and friends work without proto/transaction.proto.
+func startGRPC() error {
+	if config.grpcPort == "" {
+		return nil
+	}
+
+	file, err := grpcFile()
+	if err != nil {
+		return err
+	}
+	err = protoregistry.GlobalFiles.RegisterFile(file)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", config.grpcPort)
+	if err != nil {
+		return err
+	}
+
+	grpcServer = grpc.NewServer()
+	desc := grpcServiceDesc(file.Services().ByName("TransactionService"))
+	grpcServer.RegisterService(&desc, nil)
+	reflection.Register(grpcServer)
+
+	go func() {
+		err := grpcServer.Serve(listener)
+		failGracefully(err, "gRPC server stopped")
+	}()
+	logger.Info("gRPC listening", "port", config.grpcPort)
+	return nil
+}
+
+//	Let unary calls finish until ctx is done, but end account streams straight away
+func stopGRPC(ctx context.Context) {
+	if grpcServer == nil {
+		return
+	}
+	close(grpcStopping)
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+}
+
+// The protobuf messages are the Go types themselves: fields are numbered in
+// the order they're declared and named in snake_case. Keep
+// proto/transaction.proto in step when changing them, the tests check it.
+func grpcFile() (protoreflect.FileDescriptor, error) {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("transaction.proto"),
+		Package: proto.String(grpcPackage),
+		Syntax:  proto.String("proto3"),
+	}
+	service := &descriptorpb.ServiceDescriptorProto{Name: proto.String("TransactionService")}
+
+	seen := map[string]bool{}
+	message := func(t reflect.Type) *string {
+		if !seen[t.Name()] {
+			seen[t.Name()] = true
+			file.MessageType = append(file.MessageType, messageDescriptor(t))
+		}
+		return proto.String("." + grpcPackage + "." + t.Name())
+	}
+
+	for _, m := range grpcMethods {
+		body, ok := commandBodies[m.command]
+		if !ok {
+			return nil, errors.New("no request type for " + m.command)
+		}
+		service.Method = append(service.Method, &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String(m.name),
+			InputType:  message(reflect.TypeOf(body)),
+			OutputType: message(reflect.TypeOf(m.response)),
+		})
+	}
+	service.Method = append(service.Method, &descriptorpb.MethodDescriptorProto{
+		Name:            proto.String("DumpLog"),
+		InputType:       message(reflect.TypeOf(DumpLogRequest{})),
+		OutputType:      message(reflect.TypeOf(DumpLogResponse{})),
+		ServerStreaming: proto.Bool(true),
+	}, &descriptorpb.MethodDescriptorProto{
+		Name:            proto.String("WatchAccount"),
+		InputType:       message(reflect.TypeOf(UserRequest{})),
+		OutputType:      message(reflect.TypeOf(AccountEvent{})),
+		ServerStreaming: proto.Bool(true),
+	})
+	file.Service = []*descriptorpb.ServiceDescriptorProto{service}
+
+	return protodesc.NewFile(file, protoregistry.GlobalFiles)
+}
+
+func messageDescriptor(t reflect.Type) *descriptorpb.DescriptorProto {
+	message := &descriptorpb.DescriptorProto{Name: proto.String(t.Name())}
+	for i := 0; i < t.NumField(); i++ {
+		var fieldType descriptorpb.FieldDescriptorProto_Type
+		switch t.Field(i).Type.Kind() {
+		case reflect.String:
+			fieldType = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		case reflect.Int, reflect.Int64:
+			fieldType = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		case reflect.Bool:
+			fieldType = descriptorpb.FieldDescriptorProto_TYPE_BOOL
+		case reflect.Slice:
+			fieldType = descriptorpb.FieldDescriptorProto_TYPE_BYTES
+		}
+
+		message.Field = append(message.Field, &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(snakeCase(t.Field(i).Name)),
+			Number: proto.Int32(int32(i + 1)),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   fieldType.Enum(),
+		})
+	}
+	return message
+}
+
+//	UserId becomes user_id
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func grpcServiceDesc(service protoreflect.ServiceDescriptor) grpc.ServiceDesc {
+	desc := grpc.ServiceDesc{
+		ServiceName: grpcService,
+		HandlerType: (*interface{})(nil),
+		Metadata:    "transaction.proto",
+	}
+
+	for _, m := range grpcMethods {
+		name, command := m.name, m.command
+		method := service.Methods().ByName(protoreflect.Name(name))
+
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: name,
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := dynamicpb.NewMessage(method.Input())
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				call := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return callCommand(ctx, command, req.(*dynamicpb.Message), method.Output())
+				}
+				if interceptor == nil {
+					return call(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcService + "/" + name}, call)
+			},
+		})
+	}
+
+	dump := service.Methods().ByName("DumpLog")
+	watch := service.Methods().ByName("WatchAccount")
+	desc.Streams = []grpc.StreamDesc{{
+		StreamName:    "DumpLog",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return dumpLog(stream, dump)
+		},
+	}, {
+		StreamName:    "WatchAccount",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return watchAccount(stream, watch)
+		},
+	}}
+	return desc
+}
+
+// Runs the command on the request message. Only fields the caller set are
+// copied into the request, so unset ones get the same defaults as over HTTP.
+func callCommand(ctx context.Context, command string, in *dynamicpb.Message, output protoreflect.MessageDescriptor) (*dynamicpb.Message, error) {
+	resp, err := runGRPCCommand(ctx, command, in)
+	if err != nil {
+		return nil, err
+	}
+
+	out := dynamicpb.NewMessage(output)
+	if quote, ok := resp.(QuoteResponse); ok {
+		setFields(out, quote)
+	}
+	return out, nil
+}
+
+//	The command's response, or its failure as a gRPC status
+func runGRPCCommand(ctx context.Context, command string, in *dynamicpb.Message) (interface{}, error) {
+	req := commandFuncs[command].request()
+	getFields(in, req)
+
+	workload := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("traceparent"); len(values) > 0 {
+			ctx = propagator.Extract(ctx, propagation.MapCarrier{"traceparent": values[0]})
+		}
+		if values := md.Get(workloadFileHeader); len(values) > 0 {
+			workload = values[0]
+		}
+	}
+
+	resp, err := runCommand(ctx, command, req, nil, workload)
+	if err != nil {
+		apiErr := asAPIError(err)
+		grpc.SetTrailer(ctx, metadata.Pairs("error-code", apiErr.Code))
+		return nil, grpcstatus.Error(grpcCode(apiErr.Status), apiErr.Message)
+	}
+	return resp, nil
+}
+
+//	Streams the log as the audit server sends it, dumpLogChunkBytes at a time.
+//	There's always at least one message, for the content type.
+func dumpLog(stream grpc.ServerStream, method protoreflect.MethodDescriptor) error {
+	in := dynamicpb.NewMessage(method.Input())
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	resp, err := runGRPCCommand(stream.Context(), "DUMPLOG", in)
+	if err != nil {
+		return err
+	}
+	log := resp.(*dumpedLog)
+	defer log.Body.Close()
+
+	plain, err := log.plain()
+	if err != nil {
+		return grpcstatus.Error(codes.Unavailable, "unreadable dumplog: "+err.Error())
+	}
+
+	contentType := log.ContentType
+	buf := make([]byte, dumpLogChunkBytes)
+	for sent := false; ; sent = true {
+		n, err := io.ReadFull(plain, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return grpcstatus.Error(codes.Unavailable, "error reading dumplog: "+err.Error())
+		}
+		if n > 0 || !sent {
+			out := dynamicpb.NewMessage(method.Output())
+			setFields(out, DumpLogResponse{ContentType: contentType, Log: buf[:n]})
+			if err := stream.SendMsg(out); err != nil {
+				return err
+			}
+			contentType = ""
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+//	Copies the fields set in in to req, a pointer to the Go type in's
+//	message was built from. Field numbers are struct field positions, see
+//	grpcFile.
+func getFields(in *dynamicpb.Message, req interface{}) {
+	val := reflect.ValueOf(req).Elem()
+	in.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch f := val.Field(int(field.Number()) - 1); f.Kind() {
+		case reflect.String:
+			f.SetString(value.String())
+		case reflect.Int, reflect.Int64:
+			f.SetInt(value.Int())
+		case reflect.Bool:
+			f.SetBool(value.Bool())
+		case reflect.Slice:
+			f.SetBytes(value.Bytes())
+		}
+		return true
+	})
+}
+
+func setFields(out *dynamicpb.Message, v interface{}) {
+	val := reflect.ValueOf(v)
+	fields := out.Descriptor().Fields()
+	for i := 0; i < val.NumField(); i++ {
+		field := fields.ByNumber(protoreflect.FieldNumber(i + 1))
+		switch f := val.Field(i); f.Kind() {
+		case reflect.String:
+			out.Set(field, protoreflect.ValueOfString(f.String()))
+		case reflect.Int, reflect.Int64:
+			out.Set(field, protoreflect.ValueOfInt64(f.Int()))
+		case reflect.Bool:
+			out.Set(field, protoreflect.ValueOfBool(f.Bool()))
+		case reflect.Slice:
+			out.Set(field, protoreflect.ValueOfBytes(f.Bytes()))
+		}
+	}
+}
+
+//	The HTTP statuses failWithError uses, as gRPC codes
+func grpcCode(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
+
+//	Streams the user's account events until they hang up
+func watchAccount(stream grpc.ServerStream, method protoreflect.MethodDescriptor) error {
+	in := dynamicpb.NewMessage(method.Input())
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	userId := in.Get(method.Input().Fields().ByName("user_id")).String()
+	if !userIdFormat.MatchString(userId) {
+		return grpcstatus.Error(codes.InvalidArgument, errInvalidUser.Message)
+	}
+
+	events, cancel := accountEvents.Subscribe(userId)
+	defer cancel()
+	logFor(stream.Context()).Info("Watching account", "user", userId)
+
+	for {
+		select {
+		case event := <-events:
+			out := dynamicpb.NewMessage(method.Output())
+			setFields(out, event)
+			if err := stream.SendMsg(out); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-grpcStopping:
+			return grpcstatus.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
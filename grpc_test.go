@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+//	A client for the service, served on a local port for the test
+func grpcTestClient(t *testing.T) (*grpc.ClientConn, protoreflect.ServiceDescriptor) {
+	file, err := grpcFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := file.Services().ByName("TransactionService")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	desc := grpcServiceDesc(service)
+	server.RegisterService(&desc, nil)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, service
+}
+
+var (
+	protoRPC     = regexp.MustCompile(`rpc (\w+)\((\w+)\) returns \((stream )?(\w+)\);`)
+	protoMessage = regexp.MustCompile(`message (\w+) \{([^}]*)\}`)
+	protoField   = regexp.MustCompile(`(\w+) (\w+) = (\d+);`)
+)
+
+//	The RPCs and message fields in a .proto file, one per line, sorted
+func protoSummary(text string) []string {
+	var lines []string
+	for _, rpc := range protoRPC.FindAllStringSubmatch(text, -1) {
+		lines = append(lines, fmt.Sprintf("rpc %s(%s) returns (%s%s)", rpc[1], rpc[2], rpc[3], rpc[4]))
+	}
+	for _, message := range protoMessage.FindAllStringSubmatch(text, -1) {
+		lines = append(lines, "message "+message[1])
+		for _, field := range protoField.FindAllStringSubmatch(message[2], -1) {
+			lines = append(lines, fmt.Sprintf("%s.%s %s = %s", message[1], field[2], field[1], field[3]))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+//	The same for the descriptor the server is built from
+func descriptorSummary(file protoreflect.FileDescriptor) []string {
+	var lines []string
+	methods := file.Services().ByName("TransactionService").Methods()
+	for i := 0; i < methods.Len(); i++ {
+		m := methods.Get(i)
+		stream := ""
+		if m.IsStreamingServer() {
+			stream = "stream "
+		}
+		lines = append(lines, fmt.Sprintf("rpc %s(%s) returns (%s%s)", m.Name(), m.Input().Name(), stream, m.Output().Name()))
+	}
+	for i := 0; i < file.Messages().Len(); i++ {
+		message := file.Messages().Get(i)
+		lines = append(lines, "message "+string(message.Name()))
+		for j := 0; j < message.Fields().Len(); j++ {
+			field := message.Fields().Get(j)
+			lines = append(lines, fmt.Sprintf("%s.%s %s = %d", message.Name(), field.Name(), field.Kind(), field.Number()))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+//	proto/transaction.proto is kept by hand, it has to say what's served
+func TestProtoFileMatchesService(t *testing.T) {
+	text, err := ioutil.ReadFile("proto/transaction.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := grpcFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := descriptorSummary(file)
+	got := protoSummary(string(text))
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("proto/transaction.proto has\n\t%s\nbut the server serves\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+//	A log bigger than a message comes in several, and nothing is lost
+func TestDumpLogStreamsInChunks(t *testing.T) {
+	fakeServices(t, "1.00")
+	dumped := bytes.Repeat([]byte("<userCommand/>\n"), 3*dumpLogChunkBytes/15)
+	auditServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(dumped)
+	}))
+	defer auditServer.Close()
+	config.auditServer, config.auditPort, _ = net.SplitHostPort(auditServer.Listener.Addr().String())
+
+	conn, service := grpcTestClient(t)
+	method := service.Methods().ByName("DumpLog")
+	stream, err := conn.NewStream(context.Background(), &grpc.StreamDesc{ServerStreams: true}, "/"+grpcService+"/DumpLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := dynamicpb.NewMessage(method.Input())
+	req.Set(method.Input().Fields().ByName("file_name"), protoreflect.ValueOfString("workload"))
+	if err := stream.SendMsg(req); err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseSend()
+
+	var log []byte
+	var contentTypes []string
+	for {
+		out := dynamicpb.NewMessage(method.Output())
+		err := stream.RecvMsg(out)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentTypes = append(contentTypes, out.Get(method.Output().Fields().ByName("content_type")).String())
+		log = append(log, out.Get(method.Output().Fields().ByName("log")).Bytes()...)
+	}
+
+	if len(contentTypes) < 3 || contentTypes[0] != "application/xml" || contentTypes[1] != "" {
+		t.Errorf("got content types %q, want application/xml then nothing over at least 3 messages", contentTypes)
+	}
+	if !bytes.Equal(log, dumped) {
+		t.Errorf("got %d bytes of log, want the %d dumped", len(log), len(dumped))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//	Set while the goroutines they're named after are running
+var (
+	buyMonitorAlive  int32
+	sellMonitorAlive int32
+	shipperAlive     int32
+)
+
+type dependencyStatus struct {
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready             bool                        `json:"ready"`
+	Server            string                      `json:"server"`
+	Dependencies      map[string]dependencyStatus `json:"dependencies"`
+	Goroutines        map[string]bool             `json:"goroutines"`
+	AuditBacklogBytes int64                       `json:"auditBacklogBytes"`
+}
+
+//	Liveness, we're up and serving HTTP
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+//	Readiness, every dependency answers in time and the background
+//	goroutines trading relies on are still running
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func() error{
+		"postgres":    checkPostgres,
+		"redis":       checkRedis,
+		"quoteServer": checkQuoteServer,
+	}
+	if config.auditSink != "xml" {
+		checks["rabbitmq"] = checkRabbitMQ
+	}
+
+	status := readiness{
+		Ready:        true,
+		Server:       SERVER,
+		Dependencies: make(map[string]dependencyStatus),
+		Goroutines: map[string]bool{
+			"buyTriggerMonitor":  atomic.LoadInt32(&buyMonitorAlive) == 1,
+			"sellTriggerMonitor": atomic.LoadInt32(&sellMonitorAlive) == 1,
+			"auditShipper":       atomic.LoadInt32(&shipperAlive) == 1,
+		},
+		AuditBacklogBytes: auditSpool.Size(),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+			result := runCheck(check)
+			mu.Lock()
+			status.Dependencies[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	for _, result := range status.Dependencies {
+		status.Ready = status.Ready && result.OK
+	}
+	for _, alive := range status.Goroutines {
+		status.Ready = status.Ready && alive
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+//	Run a check, giving up on it once the health check timeout is up
+func runCheck(check func() error) dependencyStatus {
+	timeout := time.Duration(config.healthCheckTimeout) * time.Millisecond
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = errors.New("timed out after " + timeout.String())
+	}
+
+	status := dependencyStatus{OK: err == nil, LatencyMs: int64(time.Since(start) / time.Millisecond)}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func checkPostgres() error {
+	return db.Ping()
+}
+
+func checkRedis() error {
+	c := Pool.Get()
+	defer c.Close()
+	_, err := c.Do("PING")
+	return err
+}
+
+func checkRabbitMQ() error {
+	conn := rmqConnection()
+	if conn == nil || conn.IsClosed() {
+		return errors.New("not connected")
+	}
+	return nil
+}
+
+//	Just see if something is listening, asking for a quote costs money
+func checkQuoteServer() error {
+	timeout := time.Duration(config.healthCheckTimeout) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(config.quoteServer, config.quotePort), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
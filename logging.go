@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logger is all the server needs from a logger. keyvals are alternating
+// keys and values, e.g. logger.Info("Connected", "host", config.db).
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	With(keyvals ...interface{}) Logger
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Debug(msg string, keyvals ...interface{}) { s.l.Debug(msg, keyvals...) }
+func (s slogLogger) Info(msg string, keyvals ...interface{})  { s.l.Info(msg, keyvals...) }
+func (s slogLogger) Warn(msg string, keyvals ...interface{})  { s.l.Warn(msg, keyvals...) }
+func (s slogLogger) Error(msg string, keyvals ...interface{}) { s.l.Error(msg, keyvals...) }
+
+func (s slogLogger) With(keyvals ...interface{}) Logger {
+	return slogLogger{s.l.With(keyvals...)}
+}
+
+//	The level can be changed while running, see logLevelHandler
+var (
+	logLevel        = new(slog.LevelVar)
+	logger   Logger = newLogger(os.Stderr, "logfmt")
+)
+
+func newLogger(w io.Writer, format string) Logger {
+	options := &slog.HandlerOptions{Level: logLevel}
+	if format == "json" {
+		return slogLogger{slog.New(slog.NewJSONHandler(w, options))}
+	}
+	return slogLogger{slog.New(slog.NewTextHandler(w, options))}
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, errors.New("log level must be debug, info, warn or error")
+	}
+	return level, nil
+}
+
+func initLogging() error {
+	level, err := parseLogLevel(config.logLevel)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	logger = newLogger(os.Stderr, config.logFormat).With("server", SERVER)
+	return nil
+}
+
+func debugEnabled() bool {
+	return logLevel.Level() <= slog.LevelDebug
+}
+
+type loggerKey struct{}
+
+//	The request's logger if there is one, otherwise the server's, tagged
+//	with the trace the caller is part of
+func logFor(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+func withLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+//	Logger for a command request. Every command body names the user and
+//	transaction, so peek at those without disturbing the handler's decode.
+//	A body over limit is an error, and isn't handed on.
+func requestLogger(ctx context.Context, command string, limit int64, w http.ResponseWriter, r *http.Request) (Logger, error) {
+	body, err := readBody(w, r, limit)
+	r.Body.Close()
+	if err != nil {
+		return logFor(ctx).With("command", command), err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	ids := struct {
+		UserId         string
+		TransactionNum int
+	}{}
+	json.Unmarshal(body, &ids)
+
+	return logFor(ctx).With("command", command, "user", ids.UserId, "transactionNum", ids.TransactionNum), nil
+}
+
+//	GET shows the current log level, PUT or POST a new one as the body
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 64))
+		level, err := parseLogLevel(strings.TrimSpace(string(body)))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		logLevel.Set(level)
+		logger.Info("Log level changed", "level", level.String())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, strings.ToLower(logLevel.Level().String()))
+}
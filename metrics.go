@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	commandRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tx_command_requests_total",
+		Help: "Commands handled, by command and HTTP status code.",
+	}, []string{"command", "code"})
+
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tx_command_duration_seconds",
+		Help:    "Time spent handling a command, by command and HTTP status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command", "code"})
+
+	quoteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tx_quote_duration_seconds",
+		Help:    "Round trip time of quote server requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	quotesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tx_quotes_total",
+		Help: "Quotes received, by whether the quote server had it cached.",
+	}, []string{"cached"})
+
+	quoteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tx_quote_failures_total",
+		Help: "Quote requests that failed or returned an unusable quote.",
+	})
+
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tx_redis_duration_seconds",
+		Help:    "Redis command latency, by command.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	}, []string{"command"})
+
+	postgresDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tx_postgres_duration_seconds",
+		Help:    "Postgres statement latency, by statement.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"statement"})
+
+	triggerFills = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tx_trigger_fills_total",
+		Help: "Buy and sell triggers that fired.",
+	}, []string{"side"})
+
+	auditPublishFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tx_audit_publish_failures_total",
+		Help: "Audit batches the sink failed to accept.",
+	})
+
+	auditDeadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tx_audit_dead_lettered_total",
+		Help: "Audit events set aside after the sink rejected them too many times.",
+	})
+
+	eventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tx_account_events_dropped_total",
+		Help: "Account events not delivered because a subscriber fell behind.",
+	})
+
+	pendingOrders = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "tx_pending_orders",
+		Help:        "Orders waiting to be committed or cancelled.",
+		ConstLabels: prometheus.Labels{"side": "buy"},
+	}, func() float64 { return float64(countPending(buyMap)) })
+
+	pendingSellOrders = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "tx_pending_orders",
+		Help:        "Orders waiting to be committed or cancelled.",
+		ConstLabels: prometheus.Labels{"side": "sell"},
+	}, func() float64 { return float64(countPending(sellMap)) })
+
+	auditBacklog = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tx_audit_spool_bytes",
+		Help: "Audit events spooled and not yet shipped.",
+	}, func() float64 { return float64(auditSpool.Size()) })
+
+	auditDropped = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "tx_audit_spool_dropped_total",
+		Help: "Audit events or segments thrown away by the spool overflow policy.",
+	}, func() float64 { return float64(auditSpool.Dropped()) })
+
+	activeTriggersDesc = prometheus.NewDesc("tx_active_triggers", "Users with a trigger being polled, by side and stock symbol.", []string{"side", "symbol"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(commandRequests, commandDuration, quoteDuration, quotesReceived, quoteFailures,
+		redisDuration, postgresDuration, triggerFills, auditPublishFailures, auditDeadLettered, eventsDropped,
+		pendingOrders, pendingSellOrders, auditBacklog, auditDropped, triggerCollector{})
+}
+
+func sinceSeconds(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+//	Total pending orders over every user's stack
+func countPending(orders *sync.Map) int {
+	total := 0
+	orders.Range(func(key, element interface{}) bool {
+		total += element.(Stacker).Len()
+		return true
+	})
+	return total
+}
+
+// Reports the users polling each symbol straight from the trigger maps.
+type triggerCollector struct{}
+
+func (triggerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeTriggersDesc
+}
+
+func (triggerCollector) Collect(ch chan<- prometheus.Metric) {
+	for side, triggers := range map[string]*sync.Map{"buy": buyTriggerStockMap, "sell": sellTriggerStockMap} {
+		triggers.Range(func(symbol, users interface{}) bool {
+			ch <- prometheus.MustNewConstMetric(activeTriggersDesc, prometheus.GaugeValue, float64(len(users.([]string))), side, symbol.(string))
+			return true
+		})
+	}
+}
+
+// Remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+//	Event streams flush through it
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//	Count, time and trace every call to a command handler. The span joins
+//	the caller's trace if the request carries a traceparent header. Bodies
+//	over limit are turned away before the handler sees them.
+func instrument(command string, limit int64, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, command, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		log, err := requestLogger(ctx, command, limit, w, r)
+		ctx = withLogger(ctx, log)
+
+		if err != nil {
+			writeError(recorder, asAPIError(err), 0)
+		} else {
+			handler(recorder, r.WithContext(ctx))
+		}
+
+		handled(ctx, command, start, recorder.status)
+	}
+}
+
+//	Count and time a command that has finished with status, and log it
+func handled(ctx context.Context, command string, start time.Time, status int) {
+	code := strconv.Itoa(status)
+	commandRequests.WithLabelValues(command, code).Inc()
+	commandDuration.WithLabelValues(command, code).Observe(sinceSeconds(start))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.status_code", status))
+	logFor(ctx).Info("Handled", "status", status, "latencyMs", float64(time.Since(start).Microseconds())/1000)
+}
+
+// Times every command sent over a redis connection.
+type timedConn struct {
+	redis.Conn
+}
+
+func (c timedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(commandName, args...)
+	if commandName != "" {
+		redisDuration.WithLabelValues(strings.ToUpper(commandName)).Observe(sinceSeconds(start))
+	}
+	return reply, err
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//	The body each command's handler decodes
+var commandBodies = map[string]interface{}{
+	"QUOTE":            SymbolRequest{},
+	"ADD":              AddRequest{},
+	"BUY":              OrderRequest{},
+	"CANCEL_BUY":       UserRequest{},
+	"COMMIT_BUY":       UserRequest{},
+	"SELL":             OrderRequest{},
+	"CANCEL_SELL":      UserRequest{},
+	"COMMIT_SELL":      UserRequest{},
+	"SET_BUY_AMOUNT":   OrderRequest{},
+	"CANCEL_SET_BUY":   SymbolRequest{},
+	"SET_BUY_TRIGGER":  OrderRequest{},
+	"SET_SELL_AMOUNT":  OrderRequest{},
+	"CANCEL_SET_SELL":  SymbolRequest{},
+	"SET_SELL_TRIGGER": OrderRequest{},
+	"DISPLAY_SUMMARY":  UserRequest{},
+	"DUMPLOG":          DumpLogRequest{},
+	"WATCH_ACCOUNT":    UserRequest{},
+}
+
+//	Commands that answer with more than a status
+var commandResponses = map[string]interface{}{
+	"QUOTE": QuoteResponse{},
+}
+
+//	What checkRequest enforces, by field name
+var fieldConstraints = map[string]map[string]interface{}{
+	"UserId":         {"pattern": userIdFormat.String()},
+	"StockSymbol":    {"pattern": stockSymbolFormat.String()},
+	"Amount":         {"minimum": 1, "maximum": maxRequestInt},
+	"TransactionNum": {"minimum": 1, "maximum": maxRequestInt, "default": 1},
+	"Format":         {"enum": []string{"xml", "json"}, "default": "xml"},
+}
+
+type openAPI struct {
+	schemas map[string]interface{}
+	paths   map[string]map[string]interface{}
+}
+
+// OpenAPI 3 document for the /v1 and legacy routes, built from the route
+// tables and request types the handlers use so it can't drift from them.
+func openAPISpec() (map[string]interface{}, error) {
+	spec := openAPI{schemas: map[string]interface{}{}, paths: map[string]map[string]interface{}{}}
+	spec.schemas["ErrorResponse"] = spec.schema(reflect.TypeOf(ErrorResponse{}), nil, false)
+
+	for _, rt := range v1Routes {
+		if err := spec.add(rt, "v1"); err != nil {
+			return nil, err
+		}
+	}
+	for _, rt := range legacyRoutes {
+		if err := spec.add(rt, "legacy"); err != nil {
+			return nil, err
+		}
+	}
+
+	spec.addBatch()
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "transaction-server",
+			"version": "1",
+		},
+		"paths":      spec.paths,
+		"components": map[string]interface{}{"schemas": spec.schemas},
+	}, nil
+}
+
+func (spec openAPI) add(rt route, tag string) error {
+	body, ok := commandBodies[rt.command]
+	if !ok {
+		return errors.New("no request type for " + rt.command + " at " + rt.path)
+	}
+	bodyType := reflect.TypeOf(body)
+	if _, ok := spec.schemas[bodyType.Name()]; !ok {
+		spec.schemas[bodyType.Name()] = spec.schema(bodyType, spec.required(rt.command, bodyType), true)
+	}
+
+	operation := map[string]interface{}{
+		"summary": rt.command,
+		"tags":    []string{tag},
+		"responses": map[string]interface{}{
+			"200":     spec.success(rt.command),
+			"default": jsonContent("Rejected or failed", ref("ErrorResponse")),
+		},
+	}
+
+	var parameters []interface{}
+	for _, segment := range strings.Split(rt.path, "/") {
+		switch segment {
+		case "{user}":
+			parameters = append(parameters, parameter("user", "path", fieldSchema("UserId", reflect.TypeOf(""))))
+		case "{symbol}":
+			parameters = append(parameters, parameter("symbol", "path", fieldSchema("StockSymbol", reflect.TypeOf(""))))
+		}
+	}
+	if tag == "v1" {
+		parameters = append(parameters, parameter("transactionNum", "query", fieldSchema("TransactionNum", reflect.TypeOf(0))))
+	}
+	if parameters != nil {
+		operation["parameters"] = parameters
+	}
+
+	//	/v1 bodies are optional, path and query parameters override them
+	if rt.method == "POST" {
+		operation["requestBody"] = map[string]interface{}{
+			"required": tag == "legacy",
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": ref(bodyType.Name())}},
+		}
+	}
+
+	if spec.paths[rt.path] == nil {
+		spec.paths[rt.path] = map[string]interface{}{}
+	}
+	spec.paths[rt.path][strings.ToLower(rt.method)] = operation
+	return nil
+}
+
+//	Batch items are any command's body with a Command field added
+func (spec openAPI) addBatch() {
+	var commands []string
+	var bodies []interface{}
+	for command := range commandBodies {
+		if _, ok := commandFuncs[command]; ok {
+			commands = append(commands, command)
+		}
+	}
+	sort.Strings(commands)
+	seen := map[string]bool{}
+	for _, command := range commands {
+		name := reflect.TypeOf(commandBodies[command]).Name()
+		if !seen[name] {
+			seen[name] = true
+			bodies = append(bodies, ref(name))
+		}
+	}
+
+	spec.schemas["BatchRequest"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"Commands"},
+		"properties": map[string]interface{}{
+			"Commands": map[string]interface{}{
+				"type":     "array",
+				"maxItems": maxBatchCommands,
+				"items": map[string]interface{}{
+					"allOf": []interface{}{
+						map[string]interface{}{
+							"type":       "object",
+							"required":   []string{"Command"},
+							"properties": map[string]interface{}{"Command": map[string]interface{}{"type": "string", "enum": commands}},
+						},
+						map[string]interface{}{"anyOf": bodies},
+					},
+				},
+			},
+		},
+	}
+
+	result := spec.schema(reflect.TypeOf(BatchResult{}), nil, false)
+	result["properties"].(map[string]interface{})["Error"] = ref("ErrorResponse")
+	result["properties"].(map[string]interface{})["Response"] = map[string]interface{}{"description": "The command's response body, if it has one"}
+	spec.schemas["BatchResult"] = result
+	spec.schemas["BatchResponse"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"Results": map[string]interface{}{"type": "array", "items": ref("BatchResult")},
+		},
+	}
+
+	spec.paths["/batch"] = map[string]interface{}{
+		"post": map[string]interface{}{
+			"summary": "Run commands in order per user, users in parallel",
+			"tags":    []string{"batch"},
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": ref("BatchRequest")}},
+			},
+			"responses": map[string]interface{}{
+				"200":     jsonContent("Every command's result, in order", ref("BatchResponse")),
+				"default": jsonContent("Malformed batch", ref("ErrorResponse")),
+			},
+		},
+	}
+}
+
+func (spec openAPI) success(command string) map[string]interface{} {
+	if command == "DUMPLOG" {
+		return map[string]interface{}{
+			"description": "The audit log, as the requested Format",
+			"content": map[string]interface{}{
+				"application/xml":  map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}},
+			},
+		}
+	}
+
+	if command == "WATCH_ACCOUNT" {
+		spec.schemas["AccountEvent"] = spec.schema(reflect.TypeOf(AccountEvent{}), nil, false)
+		return map[string]interface{}{
+			"description": "Server-sent events, each an AccountEvent as JSON named by its Type",
+			"content": map[string]interface{}{
+				"text/event-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			},
+		}
+	}
+
+	response, ok := commandResponses[command]
+	if !ok {
+		return map[string]interface{}{"description": "Done"}
+	}
+	responseType := reflect.TypeOf(response)
+	spec.schemas[responseType.Name()] = spec.schema(responseType, nil, false)
+	return jsonContent("Done", ref(responseType.Name()))
+}
+
+//	The fields of t the command's requestSchema insists on
+func (spec openAPI) required(command string, t reflect.Type) []string {
+	schema := requestSchemas[command]
+	var required []string
+	if _, ok := t.FieldByName("UserId"); ok && !schema.optionalUser {
+		required = append(required, "UserId")
+	}
+	if schema.symbol {
+		required = append(required, "StockSymbol")
+	}
+	if schema.amount {
+		required = append(required, "Amount")
+	}
+	return required
+}
+
+//	Request types are constrained to what checkRequest accepts
+func (spec openAPI) schema(t reflect.Type, required []string, constrained bool) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+
+		if constrained {
+			properties[name] = fieldSchema(field.Name, field.Type)
+		} else {
+			properties[name] = typeSchema(field.Type)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func fieldSchema(name string, t reflect.Type) map[string]interface{} {
+	schema := typeSchema(t)
+	for k, v := range fieldConstraints[name] {
+		schema[k] = v
+	}
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	}
+	return map[string]interface{}{}
+}
+
+func parameter(name string, in string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": in, "required": in == "path", "schema": schema}
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+	}
+}
+
+//	The spec is built once, at startup, so a route without a request type
+//	stops the server rather than serving a wrong document
+func openAPIHandler() (http.HandlerFunc, error) {
+	spec, err := openAPISpec()
+	if err != nil {
+		return nil, err
+	}
+	specJson, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(specJson)
+	}, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpecBuilds(t *testing.T) {
+	if _, err := openAPISpec(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenAPISpecHasEveryRoute(t *testing.T) {
+	spec, err := openAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := spec["paths"].(map[string]map[string]interface{})
+
+	routes := append(append([]route{}, v1Routes...), legacyRoutes...)
+	for _, rt := range routes {
+		operations, ok := paths[rt.path]
+		if !ok {
+			t.Errorf("%s %s (%s) missing from the spec", rt.method, rt.path, rt.command)
+			continue
+		}
+		if _, ok := operations[strings.ToLower(rt.method)]; !ok {
+			t.Errorf("%s %s (%s) missing from the spec", rt.method, rt.path, rt.command)
+		}
+	}
+}
+
+func TestCommandBodiesMatchRequestSchemas(t *testing.T) {
+	for command := range commandBodies {
+		if _, ok := requestSchemas[command]; !ok {
+			t.Errorf("%s has a request type but no request schema", command)
+		}
+	}
+	for command := range requestSchemas {
+		if _, ok := commandBodies[command]; !ok {
+			t.Errorf("%s has a request schema but no request type", command)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+//	What follows the command on a workload line, in order
+var workloadArgs = map[string][]string{
+	"ADD":              {"UserId", "Amount"},
+	"QUOTE":            {"UserId", "StockSymbol"},
+	"BUY":              {"UserId", "StockSymbol", "Amount"},
+	"COMMIT_BUY":       {"UserId"},
+	"CANCEL_BUY":       {"UserId"},
+	"SELL":             {"UserId", "StockSymbol", "Amount"},
+	"COMMIT_SELL":      {"UserId"},
+	"CANCEL_SELL":      {"UserId"},
+	"SET_BUY_AMOUNT":   {"UserId", "StockSymbol", "Amount"},
+	"CANCEL_SET_BUY":   {"UserId", "StockSymbol"},
+	"SET_BUY_TRIGGER":  {"UserId", "StockSymbol", "Amount"},
+	"SET_SELL_AMOUNT":  {"UserId", "StockSymbol", "Amount"},
+	"CANCEL_SET_SELL":  {"UserId", "StockSymbol"},
+	"SET_SELL_TRIGGER": {"UserId", "StockSymbol", "Amount"},
+	"DISPLAY_SUMMARY":  {"UserId"},
+	"DUMPLOG":          {"UserId", "FileName"},
+}
+
+var workloadLine = regexp.MustCompile(`^\[(\d+)\]\s*(.*)$`)
+
+//	One line of a workload file, as the body its handler takes
+type workloadCommand struct {
+	command string
+	userId  string
+	body    []byte
+}
+
+// Reads a course workload file: lines like "[1] ADD,oY01WVirLr,63511.53",
+// where the bracketed number is the TransactionNum and amounts are dollars.
+// A DUMPLOG with only a file name dumps everyone's log.
+func parseWorkload(r io.Reader) ([]workloadCommand, error) {
+	var commands []workloadCommand
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		match := workloadLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("line %d: expected [n] COMMAND,args...", lineNum)
+		}
+		transactionNum, _ := strconv.Atoi(match[1])
+		fields := strings.Split(match[2], ",")
+		command := strings.ToUpper(strings.TrimSpace(fields[0]))
+		args := fields[1:]
+
+		names, ok := workloadArgs[command]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown command %s", lineNum, command)
+		}
+		if command == "DUMPLOG" && len(args) == 1 {
+			names = names[1:]
+		}
+		if len(args) != len(names) {
+			return nil, fmt.Errorf("line %d: %s takes %d arguments, got %d", lineNum, command, len(names), len(args))
+		}
+
+		body := map[string]interface{}{"TransactionNum": transactionNum}
+		for i, name := range names {
+			arg := strings.TrimSpace(args[i])
+			if name == "Amount" {
+				body[name] = dollarsToCents(arg)
+			} else {
+				body[name] = arg
+			}
+		}
+
+		userId, _ := body["UserId"].(string)
+		encoded, _ := json.Marshal(body)
+		commands = append(commands, workloadCommand{command: command, userId: userId, body: encoded})
+	}
+	return commands, scanner.Err()
+}
+
+//	Unparseable amounts become 0, for the handler to reject
+func dollarsToCents(dollars string) int {
+	amount, err := strconv.ParseFloat(dollars, 64)
+	if err != nil {
+		return 0
+	}
+	return int(math.Round(amount * 100))
+}
+
+type replayResult struct {
+	command string
+	status  int
+	code    string
+	latency time.Duration
+}
+
+//	Runs one command, in process or against a server, and says how it went
+type replayRunner func(ctx context.Context, command workloadCommand) replayResult
+
+func inProcessRunner(workload string) replayRunner {
+	return func(ctx context.Context, command workloadCommand) replayResult {
+		start := time.Now()
+		req, decodeErr := jsonRequest(command.command, bytes.NewReader(command.body))
+		resp, err := runCommand(ctx, command.command, req, decodeErr, workload)
+		result := replayResult{command: command.command, status: http.StatusOK, latency: time.Since(start)}
+		if err != nil {
+			apiErr := asAPIError(err)
+			result.status, result.code = apiErr.Status, apiErr.Code
+		}
+		if log, ok := resp.(*dumpedLog); ok {
+			io.Copy(ioutil.Discard, log.Body)
+			log.Body.Close()
+		}
+		return result
+	}
+}
+
+func remoteRunner(target string, header http.Header, parallel int) replayRunner {
+	paths := map[string]string{}
+	for _, rt := range legacyRoutes {
+		paths[rt.command] = rt.path
+	}
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: parallel}}
+
+	return func(ctx context.Context, command workloadCommand) replayResult {
+		result := replayResult{command: command.command}
+		start := time.Now()
+		req, err := http.NewRequest("POST", strings.TrimRight(target, "/")+paths[command.command], bytes.NewReader(command.body))
+		if err != nil {
+			result.code = "CLIENT_ERROR"
+			return result
+		}
+		req = req.WithContext(ctx)
+		req.Header = header.Clone()
+		req.Header.Set("Content-Type", "application/json")
+		propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		resp, err := client.Do(req)
+		result.latency = time.Since(start)
+		if err != nil {
+			result.code = "UNREACHABLE"
+			return result
+		}
+		defer resp.Body.Close()
+
+		result.status = resp.StatusCode
+		if resp.StatusCode != http.StatusOK {
+			var failure ErrorResponse
+			json.NewDecoder(resp.Body).Decode(&failure)
+			result.code = failure.Code
+			if result.code == "" {
+				result.code = strconv.Itoa(resp.StatusCode)
+			}
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		return result
+	}
+}
+
+//	Replays commands the way the workload generator would
+func replay(ctx context.Context, commands []workloadCommand, run replayRunner, parallel int) []replayResult {
+	results := make([]replayResult, len(commands))
+	userIds := make([]string, len(commands))
+	for i, command := range commands {
+		userIds[i] = command.userId
+	}
+	inUserOrder(userIds, parallel, func(i int) {
+		results[i] = run(ctx, commands[i])
+	})
+	return results
+}
+
+// Runs run(i) for every i, each user's in order, users in parallel (at most
+// parallel at once, 0 for no limit). userIds[i] is whose i is. Ones without
+// a user wait for everything before them and hold up everything after, so
+// a closing DUMPLOG sees the whole workload.
+func inUserOrder(userIds []string, parallel int, run func(i int)) {
+	runUsers := func(from, to int) {
+		byUser := map[string][]int{}
+		var users []string
+		for i := from; i < to; i++ {
+			if _, ok := byUser[userIds[i]]; !ok {
+				users = append(users, userIds[i])
+			}
+			byUser[userIds[i]] = append(byUser[userIds[i]], i)
+		}
+
+		limit := parallel
+		if limit <= 0 {
+			limit = len(users)
+		}
+		slots := make(chan struct{}, limit)
+		var wg sync.WaitGroup
+		for _, userId := range users {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(indexes []int) {
+				defer func() { <-slots; wg.Done() }()
+				for _, i := range indexes {
+					run(i)
+				}
+			}(byUser[userId])
+		}
+		wg.Wait()
+	}
+
+	from := 0
+	for i, userId := range userIds {
+		if userId == "" {
+			runUsers(from, i)
+			run(i)
+			from = i + 1
+		}
+	}
+	runUsers(from, len(userIds))
+}
+
+//	Throughput, latency percentiles per command and errors by code
+func printReport(w io.Writer, file string, results []replayResult, users int, elapsed time.Duration) {
+	fmt.Fprintf(w, "Replayed %d commands for %d users from %s in %s (%.1f commands/s)\n\n",
+		len(results), users, file, elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	if len(results) == 0 {
+		return
+	}
+
+	byCommand := map[string][]replayResult{}
+	var commands []string
+	errorCodes := map[string]int{}
+	for _, result := range results {
+		if _, ok := byCommand[result.command]; !ok {
+			commands = append(commands, result.command)
+		}
+		byCommand[result.command] = append(byCommand[result.command], result)
+		if result.code != "" {
+			errorCodes[result.code]++
+		}
+	}
+	sort.Strings(commands)
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "command\tcount\terrors\tp50\tp90\tp99\tmax\t")
+	for _, command := range commands {
+		printLatencies(table, command, byCommand[command])
+	}
+	printLatencies(table, "all", results)
+	table.Flush()
+
+	if len(errorCodes) == 0 {
+		return
+	}
+	var codes []string
+	for code := range errorCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Fprintln(w, "\nErrors:")
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %-24s %d\n", code, errorCodes[code])
+	}
+}
+
+func printLatencies(w io.Writer, name string, results []replayResult) {
+	latencies := make([]time.Duration, len(results))
+	errors := 0
+	for i, result := range results {
+		latencies[i] = result.latency
+		if result.code != "" {
+			errors++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n", name, len(results), errors,
+		percentile(.5), percentile(.9), percentile(.99), latencies[len(latencies)-1].Round(time.Microsecond))
+}
+
+// transaction-server replay [-target URL] [-parallel N] [server flags] FILE
+//
+// Without -target the commands run in process against the configured
+// ledger, quote and audit servers, exactly as the handlers would run them.
+// With it they are sent to a running server's legacy paths.
+func replayMain(args []string) int {
+	flags := flag.NewFlagSet("transaction-server replay", flag.ContinueOnError)
+	target := flags.String("target", "", "URL of a running server to replay against, instead of in process")
+	parallel := flags.Int("parallel", 0, "most users replayed at once, 0 for all of them")
+
+	var err error
+	config, err = loadConfigFlags(flags, args)
+	if err == nil && flags.NArg() != 1 {
+		err = errors.New("replay takes one workload file")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	file := flags.Arg(0)
+
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	commands, err := parseWorkload(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, file+": "+err.Error())
+		return 1
+	}
+
+	//	Audit events are attributed to the file being replayed
+	header := http.Header{}
+	header.Set(workloadFileHeader, filepath.Base(file))
+
+	var run replayRunner
+	if *target == "" {
+		stopAudits, auditsDone := startServices()
+		defer stopServices(stopAudits, auditsDone)
+		run = inProcessRunner(header.Get(workloadFileHeader))
+	} else {
+		SERVER = serverName()
+		err = initLogging()
+		failOnError(err, "Failed to set up logging")
+		err = initTracing()
+		failOnError(err, "Failed to set up tracing")
+		defer shutdownTracing(context.Background())
+		run = remoteRunner(*target, header, *parallel)
+	}
+
+	users := map[string]bool{}
+	for _, command := range commands {
+		if command.userId != "" {
+			users[command.userId] = true
+		}
+	}
+
+	ctx, span := tracer.Start(context.Background(), "replay")
+	start := time.Now()
+	results := replay(ctx, commands, run, *parallel)
+	elapsed := time.Since(start)
+	span.End()
+
+	printReport(os.Stdout, file, results, len(users), elapsed)
+	return 0
+}
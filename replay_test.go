@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInUserOrder(t *testing.T) {
+	userIds := []string{"a", "b", "a", "c", "", "b", "a", "d", "e"}
+	const parallel = 2
+
+	var mu sync.Mutex
+	var order []int
+	running, most := 0, 0
+	inUserOrder(userIds, parallel, func(i int) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		order = append(order, i)
+		mu.Unlock()
+	})
+
+	if len(order) != len(userIds) {
+		t.Fatalf("ran %v, want all %d", order, len(userIds))
+	}
+	if most > parallel {
+		t.Errorf("%d users ran at once, want at most %d", most, parallel)
+	}
+
+	position := map[int]int{}
+	for pos, i := range order {
+		position[i] = pos
+	}
+	for i := range userIds {
+		for j := i + 1; j < len(userIds); j++ {
+			sameUser := userIds[i] == userIds[j] && userIds[i] != ""
+			barrier := userIds[i] == "" || userIds[j] == ""
+			if (sameUser || barrier) && position[i] > position[j] {
+				t.Errorf("%d (%q) ran after %d (%q)", i, userIds[i], j, userIds[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//	Until initTracing runs (or with tracing off) this is a no-op tracer
+var (
+	tracer         = otel.Tracer("github.com/moonshot-trading/transaction-server")
+	tracerProvider *sdktrace.TracerProvider
+	propagator     = propagation.TraceContext{}
+)
+
+// Exports spans to stdout or an OTLP/HTTP collector, depending on
+// config.traceExporter. Trace context is read from and written to W3C
+// traceparent headers either way, so traces from the workload generator
+// carry through to the quote server even when we don't export our own spans.
+func initTracing() error {
+	otel.SetTextMapPropagator(propagator)
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.traceExporter {
+	case "none":
+		return nil
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.traceEndpoint))
+	default:
+		err = errors.New("unknown trace exporter " + config.traceExporter)
+	}
+	if err != nil {
+		return err
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "transaction-server"),
+			attribute.String("service.instance.id", SERVER),
+		)),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	tracer = tracerProvider.Tracer("github.com/moonshot-trading/transaction-server")
+	logger.Info("Exporting traces", "exporter", config.traceExporter, "endpoint", config.traceEndpoint)
+	return nil
+}
+
+//	Send whatever spans are still buffered
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	err := tracerProvider.Shutdown(ctx)
+	failGracefully(err, "Failed to flush traces")
+}
+
+//	Mark the span in ctx as failed
+func spanError(ctx context.Context, err error, msg string) {
+	span := trace.SpanFromContext(ctx)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.SetStatus(codes.Error, msg)
+}
+
+//	W3C traceparent for the span in ctx, empty if there isn't one
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+//	The span a traceparent header points at
+func spanContextFromTraceParent(traceparent string) trace.SpanContext {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceparent})
+	return trace.SpanContextFromContext(ctx)
+}
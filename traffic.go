@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//	DUMPLOG responses can run to megabytes, only this much of one is kept
+const maxRecordedResponse = 64 * 1024
+
+// One command request and what the server said to it, a line of the
+// record-file. Bodies are kept as sent, malformed or not.
+type RecordedRequest struct {
+	Time              time.Time
+	Method            string
+	Path              string // with the query string
+	WorkloadFile      string `json:",omitempty"`
+	Body              string
+	Status            int
+	Response          string
+	ResponseTruncated bool `json:",omitempty"`
+	LatencyMs         float64
+
+	line int
+}
+
+//	Whose request it was, "" for ones that aren't any one user's
+func (rec RecordedRequest) userId() string {
+	if strings.HasPrefix(rec.Path, "/v1/users/") {
+		return strings.Split(strings.TrimPrefix(rec.Path, "/v1/users/"), "/")[0]
+	}
+	var ids struct{ UserId string }
+	json.Unmarshal([]byte(rec.Body), &ids)
+	return ids.UserId
+}
+
+type trafficRecorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+//	nil when record-file isn't set
+var trafficLog *trafficRecorder
+
+func openTrafficLog(path string) (*trafficRecorder, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &trafficRecorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (t *trafficRecorder) write(rec RecordedRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return
+	}
+	if err := t.encoder.Encode(rec); err != nil {
+		logger.Warn("Failed to record request", "path", rec.Path, "cause", err)
+	}
+}
+
+func (t *trafficRecorder) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+//	Keeps the start of the response body, as well as its status
+type bodyRecorder struct {
+	statusRecorder
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	if room := maxRecordedResponse - b.body.Len(); len(p) > room {
+		b.body.Write(p[:room])
+		b.truncated = true
+	} else {
+		b.body.Write(p)
+	}
+	return b.ResponseWriter.Write(p)
+}
+
+//	Commands over HTTP, as opposed to health checks, metrics, the spec and event streams
+func isCommandPath(path string) bool {
+	if _, ok := (route{path: accountEventsPath}).match(path); ok {
+		return false
+	}
+	if strings.HasPrefix(path, "/v1/") || path == "/batch" {
+		return true
+	}
+	for _, rt := range legacyRoutes {
+		if rt.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Appends every command request and its response to the traffic log, for
+// replay-traffic. Commands sent over gRPC aren't recorded, nor are bodies
+// too big for their command or batch, which are turned away here.
+func recordTraffic(next http.Handler) http.Handler {
+	if trafficLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isCommandPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		limit := int64(maxCommandBytes)
+		if r.URL.Path == "/batch" {
+			limit = maxBatchBytes
+		}
+		body, err := readBody(w, r, limit)
+		if err != nil {
+			writeError(w, asAPIError(err), 0)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		recorder := &bodyRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next.ServeHTTP(recorder, r)
+
+		trafficLog.write(RecordedRequest{
+			Time:              start,
+			Method:            r.Method,
+			Path:              r.URL.RequestURI(),
+			WorkloadFile:      r.Header.Get(workloadFileHeader),
+			Body:              string(body),
+			Status:            recorder.status,
+			Response:          recorder.body.String(),
+			ResponseTruncated: recorder.truncated,
+			LatencyMs:         float64(time.Since(start).Microseconds()) / 1000,
+		})
+	})
+}
+
+//	Requests are written as they finish, this puts them back in the order they came in
+func readTraffic(r io.Reader) ([]RecordedRequest, error) {
+	var records []RecordedRequest
+	decoder := json.NewDecoder(r)
+	for {
+		rec := RecordedRequest{line: len(records) + 1}
+		err := decoder.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %s", rec.line, err)
+		}
+		records = append(records, rec)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// Why a replayed response doesn't match the recorded one, "" if it does.
+// Only JSON bodies are compared, less the ignored fields: a dumped XML log
+// has timestamps all through it.
+func diffResponse(rec RecordedRequest, status int, response []byte, ignore map[string]bool) string {
+	if status != rec.Status {
+		return fmt.Sprintf("status %d, recorded %d", status, rec.Status)
+	}
+	if rec.ResponseTruncated {
+		return ""
+	}
+
+	var recorded, replayed interface{}
+	if json.Unmarshal([]byte(rec.Response), &recorded) != nil {
+		return ""
+	}
+	if json.Unmarshal(response, &replayed) != nil {
+		return "response isn't JSON any more"
+	}
+	if !reflect.DeepEqual(withoutFields(recorded, ignore), withoutFields(replayed, ignore)) {
+		return "response differs"
+	}
+	return ""
+}
+
+func withoutFields(val interface{}, ignore map[string]bool) interface{} {
+	switch val := val.(type) {
+	case map[string]interface{}:
+		for key, field := range val {
+			if ignore[key] {
+				delete(val, key)
+			} else {
+				val[key] = withoutFields(field, ignore)
+			}
+		}
+	case []interface{}:
+		for i := range val {
+			val[i] = withoutFields(val[i], ignore)
+		}
+	}
+	return val
+}
+
+//	Long responses are cut short in the report
+func excerpt(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) > 300 {
+		return string(body[:300]) + "..."
+	}
+	return string(body)
+}
+
+// transaction-server replay-traffic [-target URL] [-speed N] [-ignore FIELDS] FILE
+//
+// Sends requests recorded with record-file to a running server, each user's
+// in order and at the pace they were recorded (-speed times faster, 0 for no
+// waiting), and reports every response that differs from the recorded one.
+// Exits 1 if any did.
+func replayTrafficMain(args []string) int {
+	flags := flag.NewFlagSet("transaction-server replay-traffic", flag.ContinueOnError)
+	target := flags.String("target", "http://localhost:44416", "URL of the server to replay against")
+	speed := flags.Float64("speed", 1, "how many times faster than recorded to send requests, 0 to send them as fast as possible")
+	ignoreFields := flags.String("ignore", "Timestamp,CryptoKey,Price", "comma separated JSON fields that are expected to differ")
+
+	err := flags.Parse(args)
+	if err == nil && flags.NArg() != 1 {
+		err = errors.New("replay-traffic takes one recorded file")
+	}
+	if err == nil && *speed < 0 {
+		err = errors.New("speed can't be negative")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	file := flags.Arg(0)
+	ignore := map[string]bool{}
+	for _, field := range strings.Split(*ignoreFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignore[field] = true
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	records, err := readTraffic(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, file+": "+err.Error())
+		return 1
+	}
+	if len(records) == 0 {
+		fmt.Printf("Nothing recorded in %s\n", file)
+		return 0
+	}
+
+	type replayed struct {
+		status   int
+		response []byte
+		err      error
+	}
+	results := make([]replayed, len(records))
+	userIds := make([]string, len(records))
+	for i, rec := range records {
+		userIds[i] = rec.userId()
+	}
+
+	client := &http.Client{}
+	first := records[0].Time
+	start := time.Now()
+	inUserOrder(userIds, 0, func(i int) {
+		rec := records[i]
+		if *speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(rec.Time.Sub(first)) / *speed))))
+		}
+
+		req, err := http.NewRequest(rec.Method, strings.TrimRight(*target, "/")+rec.Path, strings.NewReader(rec.Body))
+		if err != nil {
+			results[i].err = err
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if rec.WorkloadFile != "" {
+			req.Header.Set(workloadFileHeader, rec.WorkloadFile)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			results[i].err = err
+			return
+		}
+		defer resp.Body.Close()
+		results[i].status = resp.StatusCode
+		results[i].response, results[i].err = ioutil.ReadAll(resp.Body)
+	})
+	elapsed := time.Since(start)
+
+	differed, failed := 0, 0
+	for i, rec := range records {
+		result := results[i]
+		if result.err != nil {
+			failed++
+			fmt.Printf("record %d: %s %s: %s\n", rec.line, rec.Method, rec.Path, result.err)
+			continue
+		}
+		if diff := diffResponse(rec, result.status, result.response, ignore); diff != "" {
+			differed++
+			fmt.Printf("record %d: %s %s: %s\n", rec.line, rec.Method, rec.Path, diff)
+			fmt.Printf("  recorded: %s\n  replayed: %s\n", excerpt([]byte(rec.Response)), excerpt(result.response))
+		}
+	}
+
+	fmt.Printf("\nReplayed %d requests from %s in %s: %d matched, %d differed, %d failed\n",
+		len(records), file, elapsed.Round(time.Millisecond), len(records)-differed-failed, differed, failed)
+	if differed > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
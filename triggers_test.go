@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//	The redis half of the ledger, GET and SET on a map
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]int
+}
+
+func (f *fakeRedis) Do(commandName string, args ...interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch commandName {
+	case "GET":
+		if value, ok := f.values[args[0].(string)]; ok {
+			return int64(value), nil
+		}
+		return nil, nil
+	case "SET":
+		f.values[args[0].(string)] = args[1].(int)
+	}
+	return nil, nil
+}
+
+func (f *fakeRedis) get(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values[key]
+}
+
+func (f *fakeRedis) Close() error                      { return nil }
+func (f *fakeRedis) Err() error                        { return nil }
+func (f *fakeRedis) Send(string, ...interface{}) error { return nil }
+func (f *fakeRedis) Flush() error                      { return nil }
+func (f *fakeRedis) Receive() (interface{}, error)     { return nil, nil }
+
+//	The postgres half, every statement touches one row
+type fakePostgres struct{}
+
+func (fakePostgres) Open(string) (driver.Conn, error)           { return fakePostgres{}, nil }
+func (fakePostgres) Prepare(string) (driver.Stmt, error)        { return fakePostgres{}, nil }
+func (fakePostgres) Begin() (driver.Tx, error)                  { return nil, driver.ErrSkip }
+func (fakePostgres) Close() error                               { return nil }
+func (fakePostgres) NumInput() int                              { return -1 }
+func (fakePostgres) Exec([]driver.Value) (driver.Result, error) { return driver.RowsAffected(1), nil }
+func (fakePostgres) Query([]driver.Value) (driver.Rows, error)  { return nil, driver.ErrSkip }
+
+func init() {
+	sql.Register("fake-postgres", fakePostgres{})
+}
+
+//	Point the ledger, audit spool and quote server at fakes for the test.
+//	Every quote comes back at price.
+func fakeServices(t *testing.T, price string) *fakeRedis {
+	ledger := &fakeRedis{values: map[string]int{}}
+	oldPool, oldDB, oldSpool, oldConfig := Pool, db, auditSpool, config
+	t.Cleanup(func() { Pool, db, auditSpool, config = oldPool, oldDB, oldSpool, oldConfig })
+
+	Pool = &redis.Pool{Dial: func() (redis.Conn, error) { return ledger, nil }}
+	db, _ = sql.Open("fake-postgres", "")
+	var err error
+	auditSpool, err = openSpool(t.TempDir(), 0, 1024*1024, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quotes := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req GetQuote
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Price":       price,
+			"StockSymbol": req.StockSymbol,
+			"UserId":      req.UserId,
+			"Timestamp":   time.Now().UnixNano() / int64(time.Millisecond),
+			"CryptoKey":   "key",
+		})
+	}))
+	t.Cleanup(quotes.Close)
+	host, port, _ := net.SplitHostPort(quotes.Listener.Addr().String())
+	config.quoteServer, config.quotePort = host, port
+	config.quoteTimestampSkew = 60000
+	return ledger
+}
+
+//	A trigger that has filled has spent what it reserved, so shutting down
+//	afterwards mustn't hand it back
+func TestFilledTriggersAreNotReleased(t *testing.T) {
+	ledger := fakeServices(t, "1.00")
+	ledger.values["alice"] = 100
+	ledger.values["bob,ABC"] = 2
+
+	buyTriggerMap.Store("alice,ABC", BuyTrigger{StockSymbol: "ABC", BuyAmount: 50000, BuyPrice: 20000, TransactionNum: 2})
+	addBuyTimer("ABC", "alice")
+	sellTriggerMap.Store("bob,ABC", SellTrigger{StockSymbol: "ABC", SellPrice: 5000, StockSellAmount: 3, TransactionNum: 3})
+	addSellTimer("ABC", "bob")
+
+	triggersStopping = make(chan struct{})
+	monitorBuyTriggers()
+	monitorSellTriggers()
+	aggBuy <- "ABC"
+	aggSell <- "ABC"
+	//	Waits out both fills, as shutdown does
+	stopTriggers()
+
+	filled := map[string]int{}
+	for _, key := range []string{"alice", "alice,ABC", "bob", "bob,ABC"} {
+		filled[key] = ledger.get(key)
+	}
+	if filled["alice,ABC"] != 5 || filled["bob"] != 30000 {
+		t.Fatalf("triggers didn't fill: %v", filled)
+	}
+
+	releaseReservations()
+	for key, want := range filled {
+		if got := ledger.get(key); got != want {
+			t.Errorf("%s is %d after shutdown, was %d when the triggers filled", key, got, want)
+		}
+	}
+}
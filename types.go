@@ -7,6 +7,7 @@ type Buy struct {
 	StockSymbol    string
 	StockPrice     int
 	BuyAmount      int
+	TransactionNum int
 }
 
 type Sell struct {
@@ -17,6 +18,7 @@ type Sell struct {
 	StockPrice      int
 	SellAmount      int
 	StockSellAmount int
+	TransactionNum  int
 }
 
 type BuyTrigger struct {
@@ -24,6 +26,7 @@ type BuyTrigger struct {
 	StockSymbol     string
 	BuyAmount       int
 	BuyPrice        int
+	TransactionNum  int
 }
 
 type SellTrigger struct {
@@ -32,17 +35,101 @@ type SellTrigger struct {
 	SellAmount       int
 	SellPrice        int
 	StockSellAmount  int
+	TransactionNum   int
+}
+
+// Command request bodies. Amounts and prices are in cents. These double as
+// the gRPC messages, numbered in field order, so only add fields at the end.
+type UserRequest struct {
+	UserId         string
+	TransactionNum int
+}
+
+type SymbolRequest struct {
+	UserId         string
+	StockSymbol    string
+	TransactionNum int
+}
+
+type AddRequest struct {
+	UserId         string
+	Amount         int
+	TransactionNum int
+}
+
+//	BUY, SELL and the SET_BUY_*/SET_SELL_* commands
+type OrderRequest struct {
+	UserId         string
+	StockSymbol    string
+	Amount         int
+	TransactionNum int
+}
+
+//	From and To are millisecond timestamps, 0 leaves that end open
+type DumpLogRequest struct {
+	UserId         string
+	FileName       string
+	TransactionNum int
+	Server         string
+	From           int64
+	To             int64
+	Format         string
+}
+
+//	Command responses
+type QuoteResponse struct {
+	StockSymbol    string
+	Price          int
+	Timestamp      int64
+	CryptoKey      string
+	TransactionNum int
+}
+
+//	What commands that only answer with a status answer
+type CommandResponse struct{}
+
+type ErrorResponse struct {
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	TransactionNum int    `json:"transactionNum"`
 }
 
 type transactionConfig struct {
-	quoteServer string
-	quotePort   string
-	auditServer string
-	db          string
-	redisHost   string
-	redisPort   string
-	port        string
-	rabbitMQ    string
+	quoteServer        string
+	quotePort          string
+	quoteTimestampSkew int64
+	auditServer        string
+	auditPort          string
+	db                 string
+	dbPort             string
+	dbUser             string
+	dbPassword         string
+	dbName             string
+	redisHost          string
+	redisPort          string
+	port               string
+	grpcPort           string
+	rabbitMQ           string
+	logLevel           string
+	logFormat          string
+	shutdownTimeout    int64
+	auditDrainTimeout  int64
+	healthCheckTimeout int64
+
+	serverName   string
+	workloadFile string
+
+	auditSpoolDir          string
+	auditSpoolMaxBytes     int64
+	auditSpoolSegmentBytes int64
+	auditSpoolOverflow     string
+	auditSink              string
+	auditXMLLog            string
+
+	traceExporter string
+	traceEndpoint string
+
+	recordFile string
 }
 
 //	Auditing types
@@ -1,66 +1,151 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func runningInDocker() bool {
-	_, err := os.Stat("/.dockerenv")
-	if err == nil {
-		return true
-	}
-	return false
-}
-
 func failOnError(err error, msg string) {
 	if err != nil {
-		fmt.Printf("%s: %s", msg, err)
+		logger.Error(msg, "cause", err)
 		panic(err)
 	}
 }
 
-func failWithStatusCode(err error, msg string, w http.ResponseWriter, statusCode int, auditError ErrorEvent) {
-	failGracefully(err, msg)
-	audit(auditError)
-	w.WriteHeader(statusCode)
-	fmt.Fprintf(w, msg)
-}
-
-func failGracefully(err error, msg string) {
+//	Log err, if there is one, with any extra key value pairs
+func failGracefully(err error, msg string, keyvals ...interface{}) {
 	if err != nil {
-		fmt.Printf("%s: %s", msg, err)
+		logger.Error(msg, append(keyvals, "cause", err)...)
 	}
 }
 
-func audit(auditStruct interface{}) {
-	// var path string
-	// //  Check the type of auditStruct
-	switch auditStruct.(type) {
+func audit(ctx context.Context, auditStruct interface{}) {
+	var eventType, key string
+	//  Check the type of auditStruct
+	switch event := auditStruct.(type) {
 	case AccountTransaction:
-		transactionChannel <- auditStruct
+		eventType, key = "AccountTransaction", event.Action
 
-	// case SystemEvent:
-	// 	path = "systemEvent"
+	case SystemEvent:
+		eventType, key = "SystemEvent", event.Command
 
 	case ErrorEvent:
-		errorChannel <- auditStruct
+		eventType, key = "ErrorEvent", event.Command
 
-	// case DebugEvent:
-	// 	path = "debugEvent"
+	case DebugEvent:
+		if !debugEnabled() {
+			return
+		}
+		eventType, key = "DebugEvent", event.Command
 
 	case QuoteServer:
-		quoteChannel <- auditStruct
+		eventType, key = "QuoteServer", event.StockSymbol
 
 	case UserCommand:
-		userChannel <- auditStruct
+		eventType, key = "UserCommand", event.Command
+
+	default:
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, "audit "+eventType)
+	defer span.End()
+	span.SetAttributes(attribute.String("audit.key", key))
+
+	//	Never blocks on RabbitMQ, the shipper picks it up from disk. The
+	//	traceparent goes along so publishing can be tied back to this span.
+	err := auditSpool.Append(eventType, routingWord(key), traceParent(ctx), auditStruct)
+	if err != nil {
+		logFor(ctx).Error("Failed to spool audit", "type", eventType, "key", key, "cause", err)
+		spanError(ctx, err, "Failed to spool audit")
+		return
+	}
+	logFor(ctx).Debug("Audited", "type", eventType, "key", key)
+}
+
+//	Audit events are attributed to this server. Falls back to the hostname
+//	so several instances behind a load balancer can be told apart.
+func serverName() string {
+	if config.serverName != "" {
+		return config.serverName
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "1"
+	}
+	return hostname
+}
+
+//	The workload generator names the file a command came from in this header
+const workloadFileHeader = "X-Workload-File"
+
+//	A user's session ends this long after their last command, unless they
+//	still have a trigger set
+const sessionIdle = time.Hour
+
+type session struct {
+	workloadFile string
+	lastSeen     time.Time
+}
+
+//	Workload file for a request. Remembered per user so events raised later
+//	on their behalf (expiries, trigger fills) are attributed to the same file.
+func workloadFile(r *http.Request, userId string) string {
+	return userWorkloadFile(r.Header.Get(workloadFileHeader), userId)
+}
+
+//	Workload file for a command run in process, requested is the one the
+//	caller named if it did
+func userWorkloadFile(requested string, userId string) string {
+	filename := requested
+	if filename == "" {
+		s, ok := userWorkloadFiles.Load(userId)
+		if !ok {
+			return config.workloadFile
+		}
+		filename = s.(session).workloadFile
+	}
+	if userId != "" {
+		userWorkloadFiles.Store(userId, session{workloadFile: filename, lastSeen: time.Now()})
+	}
+	return filename
+}
+
+func sessionWorkloadFile(userId string) string {
+	if s, ok := userWorkloadFiles.Load(userId); ok {
+		return s.(session).workloadFile
+	}
+	return config.workloadFile
+}
+
+//	Forget the workload files of users whose sessions have ended
+func endIdleSessions() {
+	for {
+		time.Sleep(time.Minute)
+
+		triggerUsers := map[string]bool{}
+		for _, triggers := range []*sync.Map{buyTriggerMap, sellTriggerMap} {
+			triggers.Range(func(key, _ interface{}) bool {
+				triggerUsers[strings.Split(key.(string), ",")[0]] = true
+				return true
+			})
+		}
+
+		userWorkloadFiles.Range(func(userId, s interface{}) bool {
+			if time.Since(s.(session).lastSeen) > sessionIdle && !triggerUsers[userId.(string)] {
+				userWorkloadFiles.Delete(userId)
+			}
+			return true
+		})
 	}
 }
 
@@ -78,11 +163,9 @@ func clearBuys() {
 				//	if top one is too old, then the whole stack needs to be deleted
 				if buyTime+60000 < currentTime {
 
-					for element.(Stacker).Peek() != nil {
-						// cancel them repeatedly
-						nextBuy := element.(Stacker).Pop()
-						writeFundsThroughCache(key.(string), nextBuy.(Buy).BuyAmount)
-					}
+					ctx, span := tracer.Start(context.Background(), "expireBuys")
+					cancelBuys(ctx, key.(string), element.(Stacker), eventBuyExpired)
+					span.End()
 				}
 			}
 			return true
@@ -102,11 +185,9 @@ func clearSells() {
 				currentTime := int64(time.Nanosecond) * int64(time.Now().UnixNano()) / int64(time.Millisecond)
 
 				if sellTime+60000 < currentTime {
-					for element.(Stacker).Peek() != nil {
-						//nextSell := sellMap[userID].Pop()
-						nextSell := element.(Stacker).Pop()
-						writeStocksThroughCache(key.(string), nextSell.(Sell).StockSymbol, nextSell.(Sell).StockSellAmount)
-					}
+					ctx, span := tracer.Start(context.Background(), "expireSells")
+					cancelSells(ctx, key.(string), element.(Stacker), eventSellExpired)
+					span.End()
 				}
 			}
 			return true
@@ -114,156 +195,311 @@ func clearSells() {
 	}
 }
 
-func replaceFunds(thisBuy Buy, userID string) {
+//	Cancel every pending buy on the stack and give the funds back. Watchers
+//	are told with eventType: they expired, or the server is going down.
+func cancelBuys(ctx context.Context, userId string, buys Stacker, eventType string) {
+	for buys.Peek() != nil {
+		// cancel them repeatedly
+		nextBuy := buys.Pop()
+		err := writeFundsThroughCache(ctx, userId, nextBuy.(Buy).BuyAmount, nextBuy.(Buy).TransactionNum)
+		if err != nil {
+			auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_BUY", StockSymbol: nextBuy.(Buy).StockSymbol, Filename: sessionWorkloadFile(userId), Funds: nextBuy.(Buy).BuyAmount, Username: userId, ErrorMessage: "Error refunding cancelled buy", TransactionNum: nextBuy.(Buy).TransactionNum}
+			audit(ctx, auditError)
+			failGracefully(err, "Could not refund cancelled buy", "user", userId, "transactionNum", nextBuy.(Buy).TransactionNum)
+			continue
+		}
+
+		auditEvent := SystemEvent{Server: SERVER, Command: "CANCEL_BUY", StockSymbol: nextBuy.(Buy).StockSymbol, Username: userId, Filename: sessionWorkloadFile(userId), Funds: nextBuy.(Buy).BuyAmount, TransactionNum: nextBuy.(Buy).TransactionNum}
+		audit(ctx, auditEvent)
+		accountEvents.Publish(AccountEvent{Type: eventType, UserId: userId, StockSymbol: nextBuy.(Buy).StockSymbol, Amount: nextBuy.(Buy).BuyAmount, Price: nextBuy.(Buy).StockPrice, TransactionNum: nextBuy.(Buy).TransactionNum})
+	}
+}
+
+//	Cancel every pending sell on the stack and give the stocks back
+func cancelSells(ctx context.Context, userId string, sells Stacker, eventType string) {
+	for sells.Peek() != nil {
+		nextSell := sells.Pop()
+		err := writeStocksThroughCache(ctx, userId, nextSell.(Sell).StockSymbol, nextSell.(Sell).StockSellAmount)
+		if err != nil {
+			auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_SELL", StockSymbol: nextSell.(Sell).StockSymbol, Filename: sessionWorkloadFile(userId), Funds: nextSell.(Sell).SellAmount, Username: userId, ErrorMessage: "Error returning stocks for cancelled sell", TransactionNum: nextSell.(Sell).TransactionNum}
+			audit(ctx, auditError)
+			failGracefully(err, "Could not return stocks for cancelled sell", "user", userId, "transactionNum", nextSell.(Sell).TransactionNum)
+			continue
+		}
+
+		auditEvent := SystemEvent{Server: SERVER, Command: "CANCEL_SELL", StockSymbol: nextSell.(Sell).StockSymbol, Username: userId, Filename: sessionWorkloadFile(userId), Funds: nextSell.(Sell).SellAmount, TransactionNum: nextSell.(Sell).TransactionNum}
+		audit(ctx, auditEvent)
+		accountEvents.Publish(AccountEvent{Type: eventType, UserId: userId, StockSymbol: nextSell.(Sell).StockSymbol, Amount: nextSell.(Sell).SellAmount, Price: nextSell.(Sell).StockPrice, Quantity: nextSell.(Sell).StockSellAmount, TransactionNum: nextSell.(Sell).TransactionNum})
+	}
+}
+
+//	Pending orders and triggers only live in memory, so before we go down
+//	everything they have reserved goes back to its owner.
+func releaseReservations() {
+	ctx, span := tracer.Start(context.Background(), "releaseReservations")
+	defer span.End()
+
+	buyMap.Range(func(key, element interface{}) bool {
+		cancelBuys(ctx, key.(string), element.(Stacker), eventBuyCancelled)
+		return true
+	})
+
+	sellMap.Range(func(key, element interface{}) bool {
+		cancelSells(ctx, key.(string), element.(Stacker), eventSellCancelled)
+		return true
+	})
+
+	buyTriggerMap.Range(func(key, element interface{}) bool {
+		userId := strings.Split(key.(string), ",")[0]
+		trigger := element.(BuyTrigger)
+		err := writeFundsThroughCache(ctx, userId, trigger.BuyAmount, trigger.TransactionNum)
+		buyTriggerMap.Delete(key)
+		if err != nil {
+			auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_SET_BUY", StockSymbol: trigger.StockSymbol, Filename: sessionWorkloadFile(userId), Funds: trigger.BuyAmount, Username: userId, ErrorMessage: "Error refunding buy trigger", TransactionNum: trigger.TransactionNum}
+			audit(ctx, auditError)
+			failGracefully(err, "Could not refund buy trigger", "user", userId, "transactionNum", trigger.TransactionNum)
+			return true
+		}
+
+		auditEvent := SystemEvent{Server: SERVER, Command: "CANCEL_SET_BUY", StockSymbol: trigger.StockSymbol, Username: userId, Filename: sessionWorkloadFile(userId), Funds: trigger.BuyAmount, TransactionNum: trigger.TransactionNum}
+		audit(ctx, auditEvent)
+		accountEvents.Publish(AccountEvent{Type: eventBuyTriggerCancelled, UserId: userId, StockSymbol: trigger.StockSymbol, Amount: trigger.BuyAmount, TransactionNum: trigger.TransactionNum})
+		return true
+	})
+
+	sellTriggerMap.Range(func(key, element interface{}) bool {
+		userId := strings.Split(key.(string), ",")[0]
+		trigger := element.(SellTrigger)
+		var err error
+		if trigger.StockSellAmount > 0 {
+			err = writeStocksThroughCache(ctx, userId, trigger.StockSymbol, trigger.StockSellAmount)
+		}
+		sellTriggerMap.Delete(key)
+		if err != nil {
+			auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_SET_SELL", StockSymbol: trigger.StockSymbol, Filename: sessionWorkloadFile(userId), Funds: trigger.SellAmount, Username: userId, ErrorMessage: "Error returning stocks for sell trigger", TransactionNum: trigger.TransactionNum}
+			audit(ctx, auditError)
+			failGracefully(err, "Could not return stocks for sell trigger", "user", userId, "transactionNum", trigger.TransactionNum)
+			return true
+		}
+
+		auditEvent := SystemEvent{Server: SERVER, Command: "CANCEL_SET_SELL", StockSymbol: trigger.StockSymbol, Username: userId, Filename: sessionWorkloadFile(userId), Funds: trigger.SellAmount, TransactionNum: trigger.TransactionNum}
+		audit(ctx, auditEvent)
+		accountEvents.Publish(AccountEvent{Type: eventSellTriggerCancelled, UserId: userId, StockSymbol: trigger.StockSymbol, Amount: trigger.SellAmount, Quantity: trigger.StockSellAmount, TransactionNum: trigger.TransactionNum})
+		return true
+	})
+}
+
+func replaceFunds(ctx context.Context, thisBuy Buy, userID string) {
 	c := Pool.Get()
 	defer c.Close()
 
 	if c == nil {
-		fmt.Println("lol no db haha")
+		logFor(ctx).Error("No redis connection", "user", userID)
 	}
 	_, rediserr := c.Do("INCRBY", userID, thisBuy.BuyAmount)
 
 	if rediserr != nil {
-		auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_BUY", StockSymbol: thisBuy.StockSymbol, Filename: FILENAME, Funds: thisBuy.BuyAmount, Username: userID, ErrorMessage: "Error replacing funds", TransactionNum: 5}
-		audit(auditError)
-		failGracefully(rediserr, "***COULD NOT REPLACE FUNDS")
+		auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_BUY", StockSymbol: thisBuy.StockSymbol, Filename: sessionWorkloadFile(userID), Funds: thisBuy.BuyAmount, Username: userID, ErrorMessage: "Error replacing funds", TransactionNum: thisBuy.TransactionNum}
+		audit(ctx, auditError)
+		failGracefully(rediserr, "Could not replace funds", "user", userID, "transactionNum", thisBuy.TransactionNum)
 		return
 	}
 
+	auditFunds(ctx, userID, thisBuy.BuyAmount, thisBuy.TransactionNum)
+
 }
 
-func replaceStocks(thisSell Sell, userID string) {
+func replaceStocks(ctx context.Context, thisSell Sell, userID string) {
 	queryString := "UPDATE stocks SET amount = amount + $1 WHERE user_name = $2 AND stock_symbol = $3"
 	stmt, err := db.Prepare(queryString)
 
 	if err != nil {
-		auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_SELL", StockSymbol: thisSell.StockSymbol, Filename: FILENAME, Funds: thisSell.SellAmount, Username: userID, ErrorMessage: "Error replacing stocks", TransactionNum: 7}
-		audit(auditError)
-		failGracefully(err, "***COULD NOT REPLACE STOCKS")
+		auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_SELL", StockSymbol: thisSell.StockSymbol, Filename: sessionWorkloadFile(userID), Funds: thisSell.SellAmount, Username: userID, ErrorMessage: "Error replacing stocks", TransactionNum: thisSell.TransactionNum}
+		audit(ctx, auditError)
+		failGracefully(err, "Could not replace stocks", "user", userID, "transactionNum", thisSell.TransactionNum)
 		return
 	}
 
+	start := time.Now()
 	_, err = stmt.Exec(thisSell.StockSellAmount, userID, thisSell.StockSymbol)
+	postgresDuration.WithLabelValues("replace_stocks").Observe(sinceSeconds(start))
 
 	if err != nil {
-		auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_SELL", StockSymbol: thisSell.StockSymbol, Filename: FILENAME, Funds: thisSell.SellAmount, Username: userID, ErrorMessage: "Error replacing stocks", TransactionNum: 7}
-		audit(auditError)
-		failGracefully(err, "***COULD NOT REPLACE STOCKS")
+		auditError := ErrorEvent{Server: SERVER, Command: "CANCEL_SELL", StockSymbol: thisSell.StockSymbol, Filename: sessionWorkloadFile(userID), Funds: thisSell.SellAmount, Username: userID, ErrorMessage: "Error replacing stocks", TransactionNum: thisSell.TransactionNum}
+		audit(ctx, auditError)
+		failGracefully(err, "Could not replace stocks", "user", userID, "transactionNum", thisSell.TransactionNum)
 		return
 	}
 }
 
 // Can take negative fundsAmount for removing funds from account.
-func writeFundsThroughCache(userId string, fundsAmount int) error {
+// Every successful change is audited as an AccountTransaction.
+func writeFundsThroughCache(ctx context.Context, userId string, fundsAmount int, transactionNum int) error {
+	ctx, span := tracer.Start(ctx, "writeFundsThroughCache")
+	defer span.End()
+	span.SetAttributes(attribute.String("user", userId), attribute.Int("funds", fundsAmount))
+
+	err := updateFunds(userId, fundsAmount)
+	if err != nil {
+		spanError(ctx, err, "Error writing funds")
+		return err
+	}
+	auditFunds(ctx, userId, fundsAmount, transactionNum)
+	return nil
+}
+
+//	Record a funds movement and tell anyone watching, negative amounts are removals
+func auditFunds(ctx context.Context, userId string, fundsAmount int, transactionNum int) {
+	if fundsAmount == 0 {
+		return
+	}
+
+	accountEvents.Publish(AccountEvent{Type: eventFundsChanged, UserId: userId, Amount: fundsAmount, TransactionNum: transactionNum})
+
+	action := "add"
+	if fundsAmount < 0 {
+		action = "remove"
+		fundsAmount = 0 - fundsAmount
+	}
+
+	auditEvent := AccountTransaction{Server: SERVER, Action: action, Username: userId, Funds: fundsAmount, TransactionNum: transactionNum}
+	audit(ctx, auditEvent)
+}
+
+func updateFunds(userId string, fundsAmount int) error {
 	//	Get current val from redis, if it will go negative, return before running more queries
 	c := Pool.Get()
 	defer c.Close()
 
 	if c == nil {
-		return errors.New("Error connecting to redis")
+		return errLedgerUnavailable
 	}
 
 	res, rediserr := redis.Int(c.Do("GET", userId))
+	if rediserr != nil && rediserr != redis.ErrNil {
+		return errLedgerUnavailable.because(rediserr)
+	}
 
 	//	If this error is set, then we didnt recieve anything for the key userId
 	//	Need to add row for this user to pg, and entry in redis
 	if rediserr != nil {
 		//	check if trying to remove funds from a non existant account
 		if fundsAmount < 0 {
-			return errors.New("can't remove funds from non-existant account")
+			return errInsufficientFunds
 		}
 		queryString := "INSERT INTO users(user_name, funds) VALUES($1, $2)"
 		stmt, err := db.Prepare(queryString)
 		if err != nil {
-			return err
+			return errLedgerUnavailable.because(err)
 		}
+		start := time.Now()
 		_, err = stmt.Exec(userId, fundsAmount)
+		postgresDuration.WithLabelValues("insert_user").Observe(sinceSeconds(start))
 		if err != nil {
-			return err
+			return errLedgerUnavailable.because(err)
 		}
 		_, rediserr = c.Do("SET", userId, fundsAmount)
 		if rediserr != nil {
-			return err
+			return errLedgerUnavailable.because(rediserr)
 		}
 		return nil
 	}
 
 	//	if we get here, we are incrementing/decrementing an existing balance
 	if res+fundsAmount < 0 {
-		return errors.New("account operation would put balance negative")
+		return errInsufficientFunds
 	}
 
 	//	Write to the redis cache
 	_, rediserr = c.Do("SET", userId, fundsAmount+res)
 
 	if rediserr != nil {
-		return rediserr
+		return errLedgerUnavailable.because(rediserr)
 	}
 
 	//	Write to pg
 	queryString := "UPDATE users SET funds = users.funds + $1 WHERE user_name = $2"
 	stmt, err := db.Prepare(queryString)
 	if err != nil {
-		fmt.Println("Error preparing")
-		return err
+		logger.Error("Error preparing funds update", "user", userId, "cause", err)
+		return errLedgerUnavailable.because(err)
 	}
+	start := time.Now()
 	pgres, err := stmt.Exec(fundsAmount, userId)
+	postgresDuration.WithLabelValues("update_funds").Observe(sinceSeconds(start))
 
 	if err != nil {
-		return err
+		return errLedgerUnavailable.because(err)
 	}
 
 	numRows, err := pgres.RowsAffected()
 
 	if numRows < 1 {
-		return errors.New("error writing funds to postgres")
+		return errLedgerUnavailable.because(errors.New("no rows updated"))
 	}
 
 	return nil
 }
 
 // Can take negative stockAmount for removing stocks from account.
-func writeStocksThroughCache(userId string, stockSymbol string, stockAmount int) error {
+func writeStocksThroughCache(ctx context.Context, userId string, stockSymbol string, stockAmount int) error {
+	ctx, span := tracer.Start(ctx, "writeStocksThroughCache")
+	defer span.End()
+	span.SetAttributes(attribute.String("user", userId), attribute.String("stock", stockSymbol), attribute.Int("amount", stockAmount))
+
+	err := updateStocks(userId, stockSymbol, stockAmount)
+	if err != nil {
+		spanError(ctx, err, "Error writing stocks")
+	}
+	return err
+}
+
+func updateStocks(userId string, stockSymbol string, stockAmount int) error {
 	//	Get current val from redis, if it will go negative, return before running more queries
 	c := Pool.Get()
 	defer c.Close()
 
 	if c == nil {
-		return errors.New("Error connecting to redis")
+		return errLedgerUnavailable
 	}
 	res, rediserr := redis.Int(c.Do("GET", userId+","+stockSymbol))
+	if rediserr != nil && rediserr != redis.ErrNil {
+		return errLedgerUnavailable.because(rediserr)
+	}
 
 	if rediserr != nil {
 		if stockAmount < 0 {
-			return errors.New("can't remove stocks from non existing account")
+			return errInsufficientStocks
 		}
 
 		queryString := "INSERT INTO stocks(user_name, stock_symbol, amount) VALUES($1, $2, $3)"
 		stmt, err := db.Prepare(queryString)
 		if err != nil {
-			return err
+			return errLedgerUnavailable.because(err)
 		}
+		start := time.Now()
 		_, err = stmt.Exec(userId, stockSymbol, stockAmount)
+		postgresDuration.WithLabelValues("insert_stocks").Observe(sinceSeconds(start))
 		if err != nil {
-			return err
+			return errLedgerUnavailable.because(err)
 		}
 		_, rediserr = c.Do("SET", userId+","+stockSymbol, res+stockAmount)
 		if rediserr != nil {
-			return err
+			return errLedgerUnavailable.because(rediserr)
 		}
 		return nil
 	}
 
 	//	if we get to here then we need to check if the increment/decrement is going to be ok
 	if res+stockAmount < 0 {
-		return errors.New("account operation would put stock amount negative")
+		return errInsufficientStocks
 	}
 
 	//	write to redis
 	_, rediserr = c.Do("SET", userId+","+stockSymbol, res+stockAmount)
 
 	if rediserr != nil {
-		return rediserr
+		return errLedgerUnavailable.because(rediserr)
 	}
 
 	//	Write to pg
@@ -271,19 +507,21 @@ func writeStocksThroughCache(userId string, stockSymbol string, stockAmount int)
 	stmt, err := db.Prepare(queryString)
 
 	if err != nil {
-		return err
+		return errLedgerUnavailable.because(err)
 	}
 
+	start := time.Now()
 	pgres, err := stmt.Exec(stockAmount, userId, stockSymbol)
+	postgresDuration.WithLabelValues("update_stocks").Observe(sinceSeconds(start))
 
 	if err != nil {
-		return err
+		return errLedgerUnavailable.because(err)
 	}
 
 	numRows, err := pgres.RowsAffected()
 
 	if numRows < 1 {
-		return errors.New("error writing stocks to postgres")
+		return errLedgerUnavailable.because(errors.New("no rows updated"))
 	}
 
 	return nil
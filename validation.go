@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"regexp"
+)
+
+// What a command has to be given. Every command needs a valid UserId
+// (except DUMPLOG, which dumps everyone's log without one) and a
+// TransactionNum.
+type requestSchema struct {
+	symbol       bool // StockSymbol is required
+	amount       bool // Amount is required and positive
+	optionalUser bool
+}
+
+var requestSchemas = map[string]requestSchema{
+	"QUOTE":            {symbol: true},
+	"ADD":              {amount: true},
+	"BUY":              {symbol: true, amount: true},
+	"CANCEL_BUY":       {},
+	"COMMIT_BUY":       {},
+	"SELL":             {symbol: true, amount: true},
+	"CANCEL_SELL":      {},
+	"COMMIT_SELL":      {},
+	"SET_BUY_AMOUNT":   {symbol: true, amount: true},
+	"CANCEL_SET_BUY":   {symbol: true},
+	"SET_BUY_TRIGGER":  {symbol: true, amount: true},
+	"SET_SELL_AMOUNT":  {symbol: true, amount: true},
+	"CANCEL_SET_SELL":  {symbol: true},
+	"SET_SELL_TRIGGER": {symbol: true, amount: true},
+	"DISPLAY_SUMMARY":  {},
+	"DUMPLOG":          {optionalUser: true},
+	"WATCH_ACCOUNT":    {},
+}
+
+//	Sized to the users.user_name and stocks.stock_symbol columns
+var (
+	userIdFormat      = regexp.MustCompile(`^[A-Za-z0-9_-]{1,20}$`)
+	stockSymbolFormat = regexp.MustCompile(`^[A-Za-z0-9]{1,3}$`)
+)
+
+//	Amounts and transaction numbers are stored as INT
+const maxRequestInt = math.MaxInt32
+
+//	The fields commands have in common
+type commandRequest struct {
+	UserId         string
+	StockSymbol    string
+	Amount         int
+	TransactionNum int
+}
+
+// The error a command request is rejected with, nil if it's fine. A body
+// that didn't decode (decodeErr) is rejected before anything is checked.
+func checkRequest(command string, decodeErr error, req commandRequest) error {
+	if decodeErr != nil {
+		return errBadRequest.withMessage("malformed request body").because(decodeErr)
+	}
+
+	schema := requestSchemas[command]
+	switch {
+	case req.UserId == "" && schema.optionalUser:
+	case !userIdFormat.MatchString(req.UserId):
+		return errInvalidUser
+	}
+
+	if schema.symbol && !stockSymbolFormat.MatchString(req.StockSymbol) {
+		return errInvalidSymbol.withMessage("StockSymbol must be 1 to 3 letters or digits")
+	}
+
+	if schema.amount && (req.Amount <= 0 || req.Amount > maxRequestInt) {
+		return errInvalidAmount.withMessage("Amount must be a positive number of cents")
+	}
+
+	if req.TransactionNum < 1 || req.TransactionNum > maxRequestInt {
+		return errInvalidTransaction.withMessage("TransactionNum must be positive")
+	}
+
+	return nil
+}